@@ -0,0 +1,164 @@
+package v1
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configOrigins records from which file the parts of a merged config were read
+type configOrigins struct {
+	registries   map[string]string
+	schedules    string
+	purgeUnknown string
+	// conflicts are found while merging and reported by Validate
+	conflicts []error
+}
+
+// ConfigFiles expands paths to the configuration files in the order they are given.
+// A path can be a file, a shell glob like conf.d/*.yaml or a directory, directories contribute their *.yaml and *.yml files
+// in lexical order, hidden files are skipped.
+func ConfigFiles(paths []string) ([]string, error) {
+	var (
+		files []string
+		seen  = make(map[string]bool)
+	)
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	for _, path := range paths {
+		if strings.ContainsAny(path, "*?[") {
+			matches, err := filepath.Glob(path)
+			if err != nil {
+				return nil, fmt.Errorf("config path is an invalid glob, path:%q %w", path, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no config files match, path:%q", path)
+			}
+			for _, match := range matches {
+				add(match)
+			}
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config path %w", err)
+		}
+		if !info.IsDir() {
+			add(path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config directory %w", err)
+		}
+		var found bool
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || (ext != ".yaml" && ext != ".yml") {
+				continue
+			}
+			found = true
+			add(filepath.Join(path, entry.Name()))
+		}
+		if !found {
+			return nil, fmt.Errorf("config directory contains no yaml files, path:%q", path)
+		}
+	}
+	return files, nil
+}
+
+// Merge adds the config read from the origin file. Images are appended, registries which are defined in several files
+// with different settings, schedules and purge_unknown which are set in several files are reported as conflicts by Validate.
+// The lines recorded by ParseConfig are kept as origin.
+func (c *Config) Merge(origin string, other Config) {
+	if c.origins == nil {
+		c.origins = &configOrigins{registries: make(map[string]string)}
+	}
+	parsed := other.origins
+	if parsed == nil {
+		parsed = &configOrigins{}
+	}
+	at := func(line string) string {
+		if line != "" {
+			return line
+		}
+		return origin
+	}
+
+	for _, image := range other.Images {
+		image.origin = at(image.origin)
+		c.Images = append(c.Images, image)
+	}
+
+	for name, registry := range other.Registries {
+		if existing, ok := c.Registries[name]; ok {
+			if existing != registry {
+				c.origins.conflicts = append(c.origins.conflicts, fmt.Errorf("registry is defined with different settings in several files, registry:%q, files:%q,%q", name, c.origins.registries[name], at(parsed.registries[name])))
+			}
+			continue
+		}
+		if c.Registries == nil {
+			c.Registries = make(map[string]Registry)
+		}
+		c.Registries[name] = registry
+		c.origins.registries[name] = at(parsed.registries[name])
+	}
+
+	if other.Schedules != nil {
+		if c.Schedules != nil {
+			c.origins.conflicts = append(c.origins.conflicts, fmt.Errorf("schedules are defined in several files, files:%q,%q", c.origins.schedules, at(parsed.schedules)))
+		} else {
+			c.Schedules = other.Schedules
+			c.origins.schedules = at(parsed.schedules)
+		}
+	}
+
+	if other.PurgeUnknown != nil {
+		if c.PurgeUnknown != nil {
+			c.origins.conflicts = append(c.origins.conflicts, fmt.Errorf("purge_unknown is defined in several files, files:%q,%q", c.origins.purgeUnknown, at(parsed.purgeUnknown)))
+		} else {
+			c.PurgeUnknown = other.PurgeUnknown
+			c.origins.purgeUnknown = at(parsed.purgeUnknown)
+		}
+	}
+}
+
+// registryOrigin returns the file the registry was read from, empty if the config was not merged from files
+func (c Config) registryOrigin(name string) string {
+	if c.origins == nil {
+		return ""
+	}
+	return c.origins.registries[name]
+}
+
+// mergeConflicts returns the conflicts found while merging config files
+func (c Config) mergeConflicts() []error {
+	if c.origins == nil {
+		return nil
+	}
+	return c.origins.conflicts
+}
+
+// inFile appends the origin file to the errors of an entry, the errors are returned unchanged if the origin is unknown
+func inFile(origin string, errs []error) []error {
+	if origin == "" {
+		return errs
+	}
+	for i, err := range errs {
+		errs[i] = fmt.Errorf("%w, file:%q", err, origin)
+	}
+	return errs
+}
+
+// definedIn describes where a conflicting entry was defined first, empty if the origin is unknown
+func definedIn(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	return fmt.Sprintf(" first defined in file:%q", origin)
+}
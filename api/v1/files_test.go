@@ -0,0 +1,131 @@
+package v1
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	confd := filepath.Join(dir, "conf.d")
+	require.NoError(t, os.MkdirAll(filepath.Join(confd, "..data"), 0755))
+	for _, file := range []string{"main.yaml", "conf.d/20-busybox.yml", "conf.d/10-alpine.yaml", "conf.d/.hidden.yaml", "conf.d/README.md", "extra/a.yaml", "extra/b.yaml"} {
+		path := filepath.Join(dir, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, nil, 0600))
+	}
+
+	tests := []struct {
+		name    string
+		paths   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "file",
+			paths: []string{filepath.Join(dir, "main.yaml")},
+			want:  []string{filepath.Join(dir, "main.yaml")},
+		},
+		{
+			name:  "directory and glob",
+			paths: []string{filepath.Join(dir, "main.yaml"), confd, filepath.Join(dir, "extra", "*.yaml")},
+			want: []string{
+				filepath.Join(dir, "main.yaml"),
+				filepath.Join(confd, "10-alpine.yaml"),
+				filepath.Join(confd, "20-busybox.yml"),
+				filepath.Join(dir, "extra", "a.yaml"),
+				filepath.Join(dir, "extra", "b.yaml"),
+			},
+		},
+		{
+			name:  "files are read once",
+			paths: []string{filepath.Join(dir, "extra", "b.yaml"), filepath.Join(dir, "extra")},
+			want:  []string{filepath.Join(dir, "extra", "b.yaml"), filepath.Join(dir, "extra", "a.yaml")},
+		},
+		{
+			name:    "missing file",
+			paths:   []string{filepath.Join(dir, "missing.yaml")},
+			wantErr: true,
+		},
+		{
+			name:    "glob without match",
+			paths:   []string{filepath.Join(dir, "*.json")},
+			wantErr: true,
+		},
+		{
+			name:    "directory without yaml files",
+			paths:   []string{filepath.Join(confd, "..data")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ConfigFiles(tt.paths)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	main := Config{
+		Registries: map[string]Registry{"r.example.com": {Concurrency: 2}},
+		Schedules:  &Schedules{Mirror: "@hourly"},
+		Images: []ImageMirror{
+			{Source: "alpine", Destination: "r.example.com/library/alpine", Match: Match{AllTags: true}},
+		},
+	}
+	busybox := Config{
+		Registries: map[string]Registry{"r.example.com": {Concurrency: 2}, "docker.io": {Concurrency: 1}},
+		Images: []ImageMirror{
+			{Source: "busybox", Destination: "r.example.com/library/busybox", Match: Match{AllTags: true}},
+		},
+	}
+
+	var c Config
+	c.Merge("main.yaml", main)
+	c.Merge("conf.d/busybox.yaml", busybox)
+	require.NoError(t, c.Validate())
+	require.Len(t, c.Images, 2)
+	require.Equal(t, "conf.d/busybox.yaml", c.Images[1].origin)
+	require.Equal(t, "conf.d/busybox.yaml", c.registryOrigin("docker.io"))
+	require.Equal(t, "main.yaml", c.registryOrigin("r.example.com"))
+
+	t.Run("conflicts", func(t *testing.T) {
+		conflicting := Config{
+			Registries: map[string]Registry{"r.example.com": {Concurrency: 4}},
+			Schedules:  &Schedules{Mirror: "@daily"},
+			Images: []ImageMirror{
+				{Source: "alpine", Destination: "r.example.com/library/alpine2", Match: Match{AllTags: true}},
+				{Source: "debian", Destination: "r.example.com/library/busybox", Match: Match{AllTags: true}},
+			},
+		}
+		var c Config
+		c.Merge("main.yaml", main)
+		c.Merge("conf.d/busybox.yaml", busybox)
+		c.Merge("conf.d/conflict.yaml", conflicting)
+		err := c.Validate()
+		require.ErrorContains(t, err, `registry is defined with different settings in several files, registry:"r.example.com", files:"main.yaml","conf.d/conflict.yaml"`)
+		require.ErrorContains(t, err, `schedules are defined in several files, files:"main.yaml","conf.d/conflict.yaml"`)
+		require.ErrorContains(t, err, `image source is duplicate:"alpine" first defined in file:"main.yaml", file:"conf.d/conflict.yaml"`)
+		require.ErrorContains(t, err, `image destination is duplicate:"r.example.com/library/busybox" first defined in file:"conf.d/busybox.yaml", file:"conf.d/conflict.yaml"`)
+	})
+
+	t.Run("errors report the file", func(t *testing.T) {
+		var c Config
+		c.Merge("conf.d/invalid.yaml", Config{
+			Registries: map[string]Registry{"r.example.com": {Concurrency: -1}},
+			Images:     []ImageMirror{{Source: "alpine", Destination: "r.example.com/library/alpine"}},
+		})
+		err := c.Validate()
+		require.ErrorContains(t, err, `registry.concurrency must not be negative, registry:"r.example.com", file:"conf.d/invalid.yaml"`)
+		require.ErrorContains(t, err, `no image.match criteria given, file:"conf.d/invalid.yaml"`)
+	})
+}
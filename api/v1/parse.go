@@ -0,0 +1,234 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// yaml11Bools are plain scalars which YAML 1.1 decodes as booleans
+var yaml11Bools = []string{"y", "yes", "n", "no", "on", "off", "true", "false"}
+
+// ParseConfig strictly decodes a v1 config file, unknown keys and values of the wrong type are rejected.
+// Every problem is reported with its line, images and registries remember their line for the errors of Validate.
+// The returned config contains everything which could be decoded, so that Validate can report its problems in the same pass.
+func ParseConfig(file string, raw []byte) (Config, error) {
+	var c Config
+	errs := []error{DecodeStrict(file, raw, &c)}
+	if err := c.checkHeader(); err != nil {
+		errs = append(errs, fmt.Errorf("%w, file:%q", err, file))
+	}
+	c.RecordOrigins(file, raw)
+	return c, errors.Join(errs...)
+}
+
+// DecodeStrict decodes a config file of any api version into obj, which must be a pointer to the config struct.
+// Unknown keys and values of the wrong type are all reported with their line, the rest of the file is still decoded into obj.
+func DecodeStrict(file string, raw []byte, obj any) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("unable to parse config file:%q %w", file, err)
+	}
+	// an empty file is an empty config
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	errs := checkNode(file, doc.Content[0], reflect.TypeOf(obj), "")
+	if len(errs) > 0 {
+		// the problems were removed from the document
+		pruned, err := yaml.Marshal(&doc)
+		if err != nil {
+			return errors.Join(append(errs, fmt.Errorf("unable to parse config file:%q %w", file, err))...)
+		}
+		raw = pruned
+	}
+	if err := k8syaml.UnmarshalStrict(raw, obj); err != nil {
+		errs = append(errs, fmt.Errorf("unable to parse config file:%q %w", file, err))
+	}
+	return errors.Join(errs...)
+}
+
+// RecordOrigins remembers the lines of the images, registries, schedules and purge_unknown in the config file
+// for the errors of Validate, the images must be in the order of the file.
+func (c *Config) RecordOrigins(file string, raw []byte) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil || len(doc.Content) == 0 {
+		return
+	}
+	root := doc.Content[0]
+	c.origins = &configOrigins{registries: make(map[string]string)}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case "images":
+			for j, image := range value.Content {
+				if j < len(c.Images) {
+					c.Images[j].origin = position(file, image)
+					c.Images[j].keys = make(map[string]string)
+					keyPositions(file, image, "", c.Images[j].keys)
+				}
+			}
+		case "registries":
+			for k := 0; k+1 < len(value.Content); k += 2 {
+				c.origins.registries[value.Content[k].Value] = position(file, value.Content[k])
+			}
+		case "schedules":
+			c.origins.schedules = position(file, key)
+		case "purge_unknown":
+			c.origins.purgeUnknown = position(file, key)
+		}
+	}
+}
+
+// keyPositions records the position of every key and list item below the node by its path, e.g. match.semver or destinations[0]
+func keyPositions(file string, node *yaml.Node, path string, keys map[string]string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				keyPositions(file, value, path, keys)
+				continue
+			}
+			keys[join(path, key.Value)] = position(file, key)
+			keyPositions(file, value, join(path, key.Value), keys)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			keys[itemPath] = position(file, item)
+			keyPositions(file, item, itemPath, keys)
+		}
+	}
+}
+
+// checkNode compares a yaml node with the json fields of the type it is decoded into.
+// Unknown keys are removed and values of the wrong type are replaced by null, the rest of the node can be decoded then.
+func checkNode(file string, node *yaml.Node, t reflect.Type, path string) []error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil
+	}
+	mismatch := func(want string) []error {
+		err := fmt.Errorf("%s must be %s, file:%q", describe(path), want, position(file, node))
+		*node = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null", Line: node.Line, Column: node.Column}
+		return []error{err}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return mismatch("a mapping")
+		}
+		fields := jsonFields(t)
+		var (
+			errs  []error
+			known []*yaml.Node
+		)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			// merge keys insert the keys of another mapping
+			if key.Value == "<<" {
+				errs = append(errs, checkNode(file, value, t, path)...)
+				known = append(known, key, value)
+				continue
+			}
+			field, ok := fields[key.Value]
+			if !ok {
+				errs = append(errs, unknownKey(file, key, path, fields))
+				continue
+			}
+			errs = append(errs, checkNode(file, value, field, join(path, key.Value))...)
+			known = append(known, key, value)
+		}
+		node.Content = known
+		return errs
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return mismatch("a mapping")
+		}
+		var errs []error
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			errs = append(errs, checkNode(file, node.Content[i+1], t.Elem(), join(path, node.Content[i].Value))...)
+		}
+		return errs
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return mismatch("a list")
+		}
+		var errs []error
+		for i, item := range node.Content {
+			errs = append(errs, checkNode(file, item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return errs
+	case reflect.Bool:
+		if node.Kind != yaml.ScalarNode || (node.Tag != "!!bool" && (node.Style != 0 || !slices.Contains(yaml11Bools, strings.ToLower(node.Value)))) {
+			return mismatch("true or false")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!int" {
+			return mismatch("a number")
+		}
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode {
+			return mismatch("a string")
+		}
+	}
+	return nil
+}
+
+// jsonFields returns the types of the fields of a struct by their json name
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for field := range t.Fields() {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// unknownKey reports a key which is not a field, a key which only differs by dashes, underscores or case hints at the field
+func unknownKey(file string, key *yaml.Node, path string, fields map[string]reflect.Type) error {
+	simplify := strings.NewReplacer("-", "", "_", "")
+	for name := range fields {
+		if strings.EqualFold(simplify.Replace(key.Value), simplify.Replace(name)) {
+			return fmt.Errorf("unknown key %q in %s, did you mean %q?, file:%q", key.Value, describe(path), name, position(file, key))
+		}
+	}
+	return fmt.Errorf("unknown key %q in %s, file:%q", key.Value, describe(path), position(file, key))
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func describe(path string) string {
+	if path == "" {
+		return "config"
+	}
+	return path
+}
+
+// position returns file:line of a node
+func position(file string, node *yaml.Node) string {
+	return fmt.Sprintf("%s:%d", file, node.Line)
+}
@@ -0,0 +1,167 @@
+package v1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		want     Config
+		wantErrs []string
+	}{
+		{
+			name: "valid",
+			raw: `
+registries:
+  r.example.com:
+    concurrency: 2
+images:
+  - source: alpine
+    destination: r.example.com/library/alpine
+    include_referrers: yes
+    match:
+      tags: ["3.19"]
+`,
+			want: Config{
+				Registries: map[string]Registry{"r.example.com": {Concurrency: 2}},
+				Images: []ImageMirror{
+					{Source: "alpine", Destination: "r.example.com/library/alpine", IncludeReferrers: true, Match: Match{Tags: []string{"3.19"}}, origin: "main.yaml:6", keys: map[string]string{
+						"source":            "main.yaml:6",
+						"destination":       "main.yaml:7",
+						"include_referrers": "main.yaml:8",
+						"match":             "main.yaml:9",
+						"match.tags":        "main.yaml:10",
+						"match.tags[0]":     "main.yaml:10",
+					}},
+				},
+			},
+		},
+		{
+			name: "empty file",
+			raw:  "",
+		},
+		{
+			name: "anchors and merge keys",
+			raw: `
+defaults: &defaults
+images:
+  - &alpine
+    source: alpine
+    destination: r.example.com/library/alpine
+    match:
+      all_tags: true
+  - <<: *alpine
+    destination: r.example.com/mirror/alpine
+    typo: true
+`,
+			wantErrs: []string{
+				`unknown key "defaults" in config, file:"main.yaml:2"`,
+				`unknown key "typo" in images[1], file:"main.yaml:11"`,
+			},
+		},
+		{
+			name: "every problem is reported",
+			raw: `
+schedules:
+  mirror: "@hourly"
+  purge-unknown: "@daily"
+registries:
+  r.example.com:
+    concurrency: many
+images:
+  - source: alpine
+    destination: r.example.com/library/alpine
+    match:
+      all-tags: true
+      tags: latest
+  - source: busybox
+    destinations: r.example.com/library/busybox
+    match:
+      all_tags: "true"
+`,
+			wantErrs: []string{
+				`unknown key "purge-unknown" in schedules, did you mean "purge_unknown"?, file:"main.yaml:4"`,
+				`registries.r.example.com.concurrency must be a number, file:"main.yaml:7"`,
+				`unknown key "all-tags" in images[0].match, did you mean "all_tags"?, file:"main.yaml:12"`,
+				`images[0].match.tags must be a list, file:"main.yaml:13"`,
+				`images[1].destinations must be a list, file:"main.yaml:15"`,
+				`images[1].match.all_tags must be true or false, file:"main.yaml:17"`,
+			},
+		},
+		{
+			name:     "invalid yaml",
+			raw:      "images: [",
+			wantErrs: []string{`unable to parse config file:"main.yaml"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseConfig("main.yaml", []byte(tt.raw))
+			if len(tt.wantErrs) > 0 {
+				require.Error(t, err)
+				for _, want := range tt.wantErrs {
+					require.ErrorContains(t, err, want)
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want.Images, got.Images)
+			require.Equal(t, tt.want.Registries, got.Registries)
+		})
+	}
+}
+
+func TestParseConfigOrigins(t *testing.T) {
+	raw := `
+registries:
+  r.example.com:
+    concurrency: -1
+images:
+  - source: alpine
+    destination: r.example.com/library/alpine
+    match:
+      all_tags: true
+  - source: alpine
+    destination: r.example.com/mirror/alpine
+`
+	part, err := ParseConfig("conf.d/alpine.yaml", []byte(raw))
+	require.NoError(t, err)
+
+	var c Config
+	c.Merge("conf.d/alpine.yaml", part)
+	err = c.Validate()
+	require.ErrorContains(t, err, `registry.concurrency must not be negative, registry:"r.example.com", file:"conf.d/alpine.yaml:3"`)
+	require.ErrorContains(t, err, `image source is duplicate:"alpine" first defined in file:"conf.d/alpine.yaml:6", file:"conf.d/alpine.yaml:10"`)
+	require.ErrorContains(t, err, `no image.match criteria given, file:"conf.d/alpine.yaml:10"`)
+}
+
+func TestParseConfigPartial(t *testing.T) {
+	raw := `
+images:
+  - source: alpine
+    destinations:
+      - destination: r.example.com/library/alpine
+      - destination: r.example.com/mirror/alpine
+        match:
+          semver: "bad"
+    match:
+      all-tags: true
+      tags: ["3.19"]
+    platforms: linux/amd64
+`
+	c, err := ParseConfig("main.yaml", []byte(raw))
+	require.ErrorContains(t, err, `unknown key "all-tags" in images[0].match, did you mean "all_tags"?, file:"main.yaml:10"`)
+	require.ErrorContains(t, err, `images[0].platforms must be a list, file:"main.yaml:12"`)
+	// the rest of the file is decoded
+	require.Len(t, c.Images, 1)
+	require.Equal(t, []string{"3.19"}, c.Images[0].Match.Tags)
+	require.Len(t, c.Images[0].Destinations, 2)
+
+	err = c.Validate()
+	require.ErrorContains(t, err, `image.match.semver is invalid, image source:"alpine", semver:"bad"`)
+	require.ErrorContains(t, err, `file:"main.yaml:8"`)
+}
@@ -0,0 +1,159 @@
+package v1
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// secretFilePrefix references a file whose content is the value, e.g. file:///run/secrets/registry-password
+	secretFilePrefix = "file://"
+	redacted         = "<redacted>"
+)
+
+// secretEnvPattern matches ${ENV_VAR} references, $${ENV_VAR} escapes a literal ${ENV_VAR}
+var secretEnvPattern = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ResolveSecrets replaces the ${ENV_VAR} and file:// references in the auth of all registries with their values.
+// References which cannot be resolved are kept and reported by Validate, resolved values are not interpolated again.
+func (c *Config) ResolveSecrets() {
+	c.secrets = &secretResolution{}
+	for name, registry := range c.Registries {
+		for _, field := range registry.Auth.fields() {
+			value, err := resolveSecret(*field.value)
+			if err != nil {
+				err = fmt.Errorf("registry.auth.%s has an unresolved reference, registry:%q %w", field.name, name, err)
+				c.secrets.errs = append(c.secrets.errs, inFile(c.registryOrigin(name), []error{err})...)
+				continue
+			}
+			*field.value = value
+		}
+		c.Registries[name] = registry
+	}
+}
+
+// KeepSecretReferences accepts the ${ENV_VAR} and file:// references without resolving them,
+// e.g. to validate the config where the secrets are not available
+func (c *Config) KeepSecretReferences() {
+	c.secrets = &secretResolution{}
+}
+
+// secretResolution is the result of ResolveSecrets
+type secretResolution struct {
+	errs []error
+}
+
+// unresolvedSecrets returns an error for every reference which could not be resolved,
+// if the secrets were never resolved every reference is unresolved
+func (c Config) unresolvedSecrets() []error {
+	if c.secrets != nil {
+		return c.secrets.errs
+	}
+	var errs []error
+	for name, registry := range c.Registries {
+		for _, field := range registry.Auth.fields() {
+			if isSecretReference(*field.value) {
+				err := fmt.Errorf("registry.auth.%s has an unresolved reference, secrets must be resolved before validation, registry:%q", field.name, name)
+				errs = append(errs, inFile(c.registryOrigin(name), []error{err})...)
+			}
+		}
+	}
+	return errs
+}
+
+// secretField is a field of the registry auth which may contain references,
+// docker_config is a path to the credentials and never resolved
+type secretField struct {
+	name  string
+	value *string
+}
+
+func (a *RegistryAuth) fields() []secretField {
+	return []secretField{
+		{name: "username", value: &a.Username},
+		{name: "password", value: &a.Password},
+		{name: "identity_token", value: &a.IdentityToken},
+		{name: "registry_token", value: &a.RegistryToken},
+		{name: "credential_helper", value: &a.CredentialHelper},
+	}
+}
+
+// isSecretReference returns true if the value contains a ${ENV_VAR} or file:// reference
+func isSecretReference(value string) bool {
+	if strings.HasPrefix(value, secretFilePrefix) {
+		return true
+	}
+	for _, match := range secretEnvPattern.FindAllStringSubmatch(value, -1) {
+		if match[1] == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecret returns the content of a file:// reference without trailing newlines,
+// or the value with all ${ENV_VAR} references replaced by the environment variables
+func resolveSecret(value string) (string, error) {
+	if path, ok := strings.CutPrefix(value, secretFilePrefix); ok {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret file %w", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	var missing []string
+	resolved := secretEnvPattern.ReplaceAllStringFunc(value, func(reference string) string {
+		match := secretEnvPattern.FindStringSubmatch(reference)
+		if match[1] != "" {
+			return "${" + match[2] + "}"
+		}
+		env, ok := os.LookupEnv(match[2])
+		if !ok {
+			missing = append(missing, match[2])
+		}
+		return env
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variables are not set:%s", strings.Join(missing, ","))
+	}
+	return resolved, nil
+}
+
+// String redacts the password and tokens
+func (a RegistryAuth) String() string {
+	r := a.redacted()
+	return fmt.Sprintf("{username:%s password:%s identity_token:%s registry_token:%s docker_config:%s credential_helper:%s}",
+		r.Username, r.Password, r.IdentityToken, r.RegistryToken, r.DockerConfig, r.CredentialHelper)
+}
+
+// GoString redacts the password and tokens in %#v
+func (a RegistryAuth) GoString() string {
+	type plain RegistryAuth
+	return fmt.Sprintf("%#v", plain(a.redacted()))
+}
+
+// LogValue redacts the password and tokens in logs
+func (a RegistryAuth) LogValue() slog.Value {
+	r := a.redacted()
+	return slog.GroupValue(
+		slog.String("username", r.Username),
+		slog.String("password", r.Password),
+		slog.String("identity_token", r.IdentityToken),
+		slog.String("registry_token", r.RegistryToken),
+		slog.String("docker_config", r.DockerConfig),
+		slog.String("credential_helper", r.CredentialHelper),
+	)
+}
+
+func (a RegistryAuth) redacted() RegistryAuth {
+	for _, secret := range []*string{&a.Password, &a.IdentityToken, &a.RegistryToken} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return a
+}
@@ -0,0 +1,119 @@
+package v1
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	t.Setenv("OCI_MIRROR_TEST_USER", "robot")
+	t.Setenv("OCI_MIRROR_TEST_EMPTY", "")
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("s3cr3t\n"), 0600))
+
+	tests := []struct {
+		name    string
+		auth    RegistryAuth
+		want    RegistryAuth
+		wantErr string
+	}{
+		{
+			name: "plain values",
+			auth: RegistryAuth{Username: "user", Password: "secret"},
+			want: RegistryAuth{Username: "user", Password: "secret"},
+		},
+		{
+			name: "environment and file",
+			auth: RegistryAuth{Username: "${OCI_MIRROR_TEST_USER}-ci", Password: "file://" + passwordFile},
+			want: RegistryAuth{Username: "robot-ci", Password: "s3cr3t"},
+		},
+		{
+			name: "empty environment variable and escaped reference",
+			auth: RegistryAuth{Username: "user${OCI_MIRROR_TEST_EMPTY}", Password: "pa$${OCI_MIRROR_TEST_USER}"},
+			want: RegistryAuth{Username: "user", Password: "pa${OCI_MIRROR_TEST_USER}"},
+		},
+		{
+			name:    "unset environment variable",
+			auth:    RegistryAuth{Username: "user", Password: "${OCI_MIRROR_TEST_UNSET}"},
+			want:    RegistryAuth{Username: "user", Password: "${OCI_MIRROR_TEST_UNSET}"},
+			wantErr: `registry.auth.password has an unresolved reference, registry:"r.example.com" environment variables are not set:OCI_MIRROR_TEST_UNSET`,
+		},
+		{
+			name:    "missing file",
+			auth:    RegistryAuth{IdentityToken: "file:///oci-mirror/missing"},
+			want:    RegistryAuth{IdentityToken: "file:///oci-mirror/missing"},
+			wantErr: `registry.auth.identity_token has an unresolved reference, registry:"r.example.com" unable to read secret file`,
+		},
+		{
+			name:    "docker config is a path",
+			auth:    RegistryAuth{DockerConfig: "file://" + passwordFile},
+			want:    RegistryAuth{DockerConfig: "file://" + passwordFile},
+			wantErr: `registry.auth.docker_config is the path to a docker config and cannot reference secrets, registry:"r.example.com"`,
+		},
+		{
+			name:    "docker config with environment variable",
+			auth:    RegistryAuth{DockerConfig: "${OCI_MIRROR_TEST_USER}/config.json"},
+			want:    RegistryAuth{DockerConfig: "${OCI_MIRROR_TEST_USER}/config.json"},
+			wantErr: `registry.auth.docker_config is the path to a docker config and cannot reference secrets, registry:"r.example.com"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{
+				Images:     []ImageMirror{{Source: "abc", Destination: "r.example.com/abc", Match: Match{AllTags: true}}},
+				Registries: map[string]Registry{"r.example.com": {Auth: tt.auth}},
+			}
+			c.ResolveSecrets()
+			require.Equal(t, tt.want, c.Registries["r.example.com"].Auth)
+
+			err := c.Validate()
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateUnresolvedSecrets(t *testing.T) {
+	c := Config{
+		Images:     []ImageMirror{{Source: "abc", Destination: "r.example.com/abc", Match: Match{AllTags: true}}},
+		Registries: map[string]Registry{"r.example.com": {Auth: RegistryAuth{Username: "user", Password: "${OCI_MIRROR_TEST_PASSWORD}"}}},
+	}
+	require.ErrorContains(t, c.Validate(), `registry.auth.password has an unresolved reference, secrets must be resolved before validation, registry:"r.example.com"`)
+
+	t.Setenv("OCI_MIRROR_TEST_PASSWORD", "secret")
+	c.ResolveSecrets()
+	require.NoError(t, c.Validate())
+}
+
+func TestRegistryAuthRedacted(t *testing.T) {
+	auth := RegistryAuth{Username: "user", Password: "pa55word", IdentityToken: "refresh-token", RegistryToken: "bearer-token"}
+	registry := Registry{Auth: auth, Concurrency: 2}
+
+	var logs bytes.Buffer
+	slog.New(slog.NewJSONHandler(&logs, nil)).Info("registry", "auth", auth)
+
+	for _, out := range []string{
+		fmt.Sprintf("%v", auth),
+		fmt.Sprintf("%+v", registry),
+		fmt.Sprintf("%#v", auth),
+		fmt.Sprintf("%#v", registry),
+		logs.String(),
+	} {
+		require.Contains(t, out, "user")
+		require.Contains(t, out, redacted)
+		for _, secret := range []string{auth.Password, auth.IdentityToken, auth.RegistryToken} {
+			require.False(t, strings.Contains(out, secret), "%q must not contain %q", out, secret)
+		}
+	}
+	require.Equal(t, "pa55word", auth.Password, "redaction must not modify the auth")
+}
@@ -3,29 +3,122 @@ package v1
 import (
 	"errors"
 	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// Group is the api group of the config
+	Group = "oci-mirror.metal-stack.io"
+	// APIVersion is the apiVersion of this config version
+	APIVersion = Group + "/v1"
+	// Kind is the kind of the config
+	Kind = "MirrorConfig"
 )
 
 // Config defines which images should be mirrored
 type Config struct {
+	// APIVersion is the version of the config schema, configs without apiVersion are read as v1
+	APIVersion string `json:"apiVersion,omitempty"`
+	// Kind must be MirrorConfig if set
+	Kind string `json:"kind,omitempty"`
 	// Images is a list of repositories to mirror
 	Images []ImageMirror `json:"images,omitempty"`
-	// Registries defines registries with authentication
+	// Registries defines source and destination registries with authentication
 	Registries map[string]Registry `json:"registries,omitempty"`
+	// Schedules defines when mirror, purge and purge-unknown run in daemon mode
+	Schedules *Schedules `json:"schedules,omitempty"`
+	// PurgeUnknown restricts purge-unknown to some repositories of the destination registries,
+	// all unknown tags of all destination registries are purged if not set.
+	PurgeUnknown *PurgeUnknown `json:"purge_unknown,omitempty"`
+
+	// secrets is set by ResolveSecrets
+	secrets *secretResolution
+	// origins is set by Merge
+	origins *configOrigins
+}
+
+// PurgeUnknown defines which repositories purge-unknown may touch, unknown tags outside of this scope are only reported
+type PurgeUnknown struct {
+	// Repositories are prefixes of the repositories which may be purged including the registry, e.g. r.example.com/library/.
+	// A prefix covers whole path segments, r.example.com/team does not cover r.example.com/team-other. All repositories may be purged if empty.
+	Repositories []string `json:"repositories,omitempty"`
+	// Protected are prefixes of repositories which are never purged, even if they are part of Repositories
+	Protected []string `json:"protected,omitempty"`
+	// Exclude are shell patterns of repositories or tags which are never purged, e.g. r.example.com/*/cache or r.example.com/library/*:*-keep
+	Exclude []string `json:"exclude,omitempty"`
 }
 
-// Registry defines a destination registry which requires authentication
+// Schedules defines cron-style schedules, e.g. "*/20 * * * *", of the runs in daemon mode
+// An empty schedule disables the run.
+type Schedules struct {
+	// Mirror is the schedule of the mirror run
+	Mirror string `json:"mirror,omitempty"`
+	// Purge is the schedule of the purge run
+	Purge string `json:"purge,omitempty"`
+	// PurgeUnknown is the schedule of the purge-unknown run
+	PurgeUnknown string `json:"purge_unknown,omitempty"`
+}
+
+// Registry defines a source or destination registry which requires authentication
 type Registry struct {
 	Auth RegistryAuth `json:"auth"`
+	// Concurrency limits the number of concurrent image copies to this registry if mirroring runs concurrently
+	Concurrency int `json:"concurrency,omitempty"`
 }
 
-// RegistryAuth is the authentication for a registry
+// RegistryAuth is the authentication for a registry.
+// Either username, password and tokens, a docker config or a credential helper can be configured,
+// registries without auth use the default docker keychain of the environment.
 type RegistryAuth struct {
 	Username string `json:"username,omitempty"`
 	Password string `json:"password,omitempty"`
+	// IdentityToken is an OAuth2 refresh token which is exchanged for a registry token
+	IdentityToken string `json:"identity_token,omitempty"`
+	// RegistryToken is a bearer token which is sent to the registry as is
+	RegistryToken string `json:"registry_token,omitempty"`
+	// DockerConfig is the path to a docker config.json, the credentials of the registry are read from its auths,
+	// credsStore or credHelpers. It is a path and cannot reference secrets.
+	DockerConfig string `json:"docker_config,omitempty"`
+	// CredentialHelper is the name of a docker credential helper, e.g. ecr-login for the docker-credential-ecr-login binary in the PATH
+	CredentialHelper string `json:"credential_helper,omitempty"`
+}
+
+func (a RegistryAuth) validate(registry string) []error {
+	var (
+		errs    []error
+		sources int
+	)
+	for _, configured := range []bool{
+		a.Username != "" || a.Password != "" || a.IdentityToken != "" || a.RegistryToken != "",
+		a.DockerConfig != "",
+		a.CredentialHelper != "",
+	} {
+		if configured {
+			sources++
+		}
+	}
+	if sources > 1 {
+		errs = append(errs, fmt.Errorf("registry.auth can only have one of username, password and tokens, docker_config or credential_helper, registry:%q", registry))
+	}
+	if a.Password != "" && a.Username == "" {
+		errs = append(errs, fmt.Errorf("registry.auth.password requires a username, registry:%q", registry))
+	}
+	if isSecretReference(a.DockerConfig) {
+		errs = append(errs, fmt.Errorf("registry.auth.docker_config is the path to a docker config and cannot reference secrets, registry:%q, docker_config:%q", registry, a.DockerConfig))
+	}
+	if strings.ContainsAny(a.CredentialHelper, `/\`) {
+		errs = append(errs, fmt.Errorf("registry.auth.credential_helper must be the name of the helper without docker-credential- prefix, registry:%q, helper:%q", registry, a.CredentialHelper))
+	}
+	return errs
 }
 
 // ImageMirror defines the mirror configuration for a single Repo
@@ -33,14 +126,179 @@ type ImageMirror struct {
 	// Source defines from which repo the images should pulled from
 	Source string `json:"source,omitempty"`
 	// Destination defines the new image repo the Source should be rewritten
-	// If prefixed with http:// insecure registry is considered
+	// If prefixed with http:// insecure registry is considered.
+	// If prefixed with oci-layout:// or tar://, the images are written to an OCI image layout directory
+	// or a tarball of it on disk, e.g. oci-layout:///var/lib/mirror, several images can share one archive.
 	Destination string `json:"destination,omitempty"`
+	// Destinations mirrors the Source to several image repos, the source tags and manifests are only read once.
+	// Every destination can override Match, Purge and Platforms. Cannot be set together with Destination.
+	Destinations []Destination `json:"destinations,omitempty"`
 	// Match defines which images to mirror
 	Match Match `json:"match"`
 	// Purge defines which images should be purged
 	Purge *Purge `json:"purge,omitempty"`
+	// Platforms restricts multi-platform images to the given platforms, e.g. linux/amd64 or linux/arm64.
+	// Only the matching platform manifests are mirrored, the image index is reduced accordingly.
+	// All platforms are mirrored if empty.
+	Platforms []string `json:"platforms,omitempty"`
+	// Schema1 defines how deprecated Docker v2 schema 1 manifests are handled, can be skip, reject or convert.
+	// Defaults to skip.
+	Schema1 Schema1Policy `json:"schema1,omitempty"`
+	// MutableTags defines when tags which already exist in the destination are overwritten, can be always, on_change or never.
+	// Defaults to on_change, which compares the source and destination digests and only copies changed tags.
+	MutableTags MutableTagsPolicy `json:"mutable_tags,omitempty"`
+	// Rewrite transforms the source tags into the destination tags, tags are mirrored unchanged if not set.
+	// Purge and purge-unknown use the same transformation, the purge criteria are matched against the destination tags.
+	Rewrite *TagRewrite `json:"rewrite,omitempty"`
+	// IncludeReferrers mirrors the signatures, attestations and SBOMs of every mirrored digest as well.
+	// They are discovered with the OCI referrers API, its tag schema fallback and the cosign tags sha256-<digest>.sig, .att and .sbom.
+	IncludeReferrers bool `json:"include_referrers,omitempty"`
+
+	// origin is the config file the image was read from
+	origin string
+	// keys are the positions of the keys of the image in the config file by their path, e.g. match.semver
+	keys map[string]string
+}
+
+// TagRewrite transforms a source tag into a destination tag, the regular expression is replaced first,
+// then prefix and suffix are added, e.g. regex "^v(.*)$" with replacement "$1" rewrites v1.2.3 to 1.2.3.
+type TagRewrite struct {
+	// Regex is replaced by Replacement in the source tag, tags which do not match are not replaced
+	Regex *string `json:"regex,omitempty"`
+	// Replacement replaces the matches of Regex, it can refer to capture groups with $1 or ${name}
+	Replacement string `json:"replacement,omitempty"`
+	// Prefix is prepended to the tag
+	Prefix string `json:"prefix,omitempty"`
+	// Suffix is appended to the tag
+	Suffix string `json:"suffix,omitempty"`
 }
 
+// Destination is one of several destinations of an image mirror
+type Destination struct {
+	// Destination defines the new image repo the Source should be rewritten
+	// If prefixed with http:// insecure registry is considered, if prefixed with oci-layout:// or tar:// it is an archive on disk
+	Destination string `json:"destination,omitempty"`
+	// Match overrides the match of the image mirror for this destination
+	Match *Match `json:"match,omitempty"`
+	// Purge overrides the purge of the image mirror for this destination
+	Purge *Purge `json:"purge,omitempty"`
+	// Platforms overrides the platforms of the image mirror for this destination
+	Platforms []string `json:"platforms,omitempty"`
+}
+
+// Mirrors returns one image mirror per destination with the overrides of the destination applied,
+// an image mirror without Destinations is returned as is.
+func (image ImageMirror) Mirrors() []ImageMirror {
+	if len(image.Destinations) == 0 {
+		return []ImageMirror{image}
+	}
+	var mirrors []ImageMirror
+	for i, d := range image.Destinations {
+		mirror := image
+		mirror.Destinations = nil
+		mirror.Destination = d.Destination
+		mirror.keys = image.destinationKeys(i)
+		if d.Match != nil {
+			mirror.Match = *d.Match
+		}
+		if d.Purge != nil {
+			mirror.Purge = d.Purge
+		}
+		if d.Platforms != nil {
+			mirror.Platforms = d.Platforms
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	return mirrors
+}
+
+// destinationKeys returns the positions of the keys of the image with the keys of the i-th destination in their place
+func (image ImageMirror) destinationKeys(i int) map[string]string {
+	if image.keys == nil {
+		return nil
+	}
+	prefix := fmt.Sprintf("destinations[%d].", i)
+	keys := make(map[string]string, len(image.keys))
+	for path, position := range image.keys {
+		if !strings.HasPrefix(path, "destinations") {
+			keys[path] = position
+		}
+	}
+	for path, position := range image.keys {
+		if rest, ok := strings.CutPrefix(path, prefix); ok {
+			keys[rest] = position
+		}
+	}
+	return keys
+}
+
+// locate appends the position of the key an error of the image refers to, e.g. image.match.semver,
+// or the position of the image if the key is unknown
+func (image ImageMirror) locate(errs []error) []error {
+	for i, err := range errs {
+		origin := image.origin
+		if rest, ok := strings.CutPrefix(err.Error(), "image."); ok {
+			// the error is located at the deepest key of its path which is in the file
+			path, _, _ := strings.Cut(rest, " ")
+			for ; path != ""; path = path[:max(strings.LastIndex(path, "."), 0)] {
+				if position, ok := image.keys[path]; ok {
+					origin = position
+					break
+				}
+			}
+		}
+		if origin != "" {
+			errs[i] = fmt.Errorf("%w, file:%q", err, origin)
+		}
+	}
+	return errs
+}
+
+// ArchiveFormat is the format of a destination on disk
+type ArchiveFormat string
+
+const (
+	// ArchiveOCILayout is an OCI image layout directory, e.g. oci-layout:///var/lib/mirror
+	ArchiveOCILayout = ArchiveFormat("oci-layout")
+	// ArchiveTar is a tarball of an OCI image layout, e.g. tar:///var/lib/mirror/bundle.tar
+	ArchiveTar = ArchiveFormat("tar")
+)
+
+// ParseArchive returns the format and the path of a destination on disk, ok is false if the destination is a registry
+func ParseArchive(destination string) (format ArchiveFormat, path string, ok bool) {
+	for _, format := range []ArchiveFormat{ArchiveOCILayout, ArchiveTar} {
+		if path, ok := strings.CutPrefix(destination, string(format)+"://"); ok {
+			return format, path, true
+		}
+	}
+	return "", "", false
+}
+
+// MutableTagsPolicy defines when tags which already exist in the destination are overwritten
+type MutableTagsPolicy string
+
+const (
+	// MutableTagsAlways copies every tag, regardless if it changed
+	MutableTagsAlways = MutableTagsPolicy("always")
+	// MutableTagsOnChange copies a tag if its digest differs from the destination,
+	// the source digest is read with a HEAD request which does not count against pull rate limits
+	MutableTagsOnChange = MutableTagsPolicy("on_change")
+	// MutableTagsNever never overwrites a tag which already exists in the destination
+	MutableTagsNever = MutableTagsPolicy("never")
+)
+
+// Schema1Policy defines how deprecated Docker v2 schema 1 manifests are handled
+type Schema1Policy string
+
+const (
+	// Schema1Skip ignores schema 1 images with a warning
+	Schema1Skip = Schema1Policy("skip")
+	// Schema1Reject fails the mirror of schema 1 images
+	Schema1Reject = Schema1Policy("reject")
+	// Schema1Convert converts schema 1 images to Docker v2 schema 2 images
+	Schema1Convert = Schema1Policy("convert")
+)
+
 type Match struct {
 	// AllTags copies all images if true
 	AllTags bool `json:"all_tags,omitempty"`
@@ -48,8 +306,30 @@ type Match struct {
 	Tags []string `json:"tags,omitempty"`
 	// Semver defines a semantic version of tags to mirror
 	Semver *string `json:"semver,omitempty"`
+	// Regex defines a regular expression of tags to mirror, it is not anchored unless ^ and $ are given
+	Regex *string `json:"regex,omitempty"`
+	// Glob defines a shell pattern of tags to mirror, e.g. *-alpine
+	Glob *string `json:"glob,omitempty"`
 	// Last defines how many of the latest tags should be mirrored
 	Last *int64 `json:"last,omitempty"`
+	// IncludePrereleases if set to true, Semver also matches pre-release tags like 1.36.0-rc1,
+	// otherwise they are only matched if the constraint contains a pre-release itself.
+	IncludePrereleases bool `json:"include_prereleases,omitempty"`
+	// Exclude removes tags matched by AllTags, Semver, Regex, Glob and Last, it is applied before the last tags are selected.
+	// Tags which are listed explicitly in Tags are never excluded.
+	Exclude *Exclude `json:"exclude,omitempty"`
+}
+
+// Exclude defines tags which must not be mirrored
+type Exclude struct {
+	// Tags is a exact list of tags to exclude
+	Tags []string `json:"tags,omitempty"`
+	// Semver defines a semantic version of tags to exclude, pre-release tags are matched regardless of IncludePrereleases
+	Semver *string `json:"semver,omitempty"`
+	// Regex defines a regular expression of tags to exclude, it is not anchored unless ^ and $ are given
+	Regex *string `json:"regex,omitempty"`
+	// Glob defines a shell pattern of tags to exclude, e.g. *-debug
+	Glob *string `json:"glob,omitempty"`
 }
 
 type Purge struct {
@@ -57,94 +337,302 @@ type Purge struct {
 	Tags []string `json:"tags,omitempty"`
 	// Semver defines a semantic version of tags to purge
 	Semver *string `json:"semver,omitempty"`
+	// Regex defines a regular expression of tags to purge, it is not anchored unless ^ and $ are given
+	Regex *string `json:"regex,omitempty"`
+	// Glob defines a shell pattern of tags to purge, e.g. *-debug
+	Glob *string `json:"glob,omitempty"`
 	// NoMatch if set to true, all images which are not matched by the Match specification will be purged.
 	// latest will never be purged
 	NoMatch bool `json:"no_match,omitempty"`
+	// Retention purges tags by their age or their number
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+// Retention defines which tags are kept by their age or their number, the other purge criteria still apply
+type Retention struct {
+	// KeepLast keeps the newest tags, older tags are purged
+	KeepLast *int64 `json:"keep_last,omitempty"`
+	// SortBy defines how the newest tags are determined, can be semver or created. Defaults to semver.
+	// Tags which are no semantic version are never purged by KeepLast if sorted by semver.
+	SortBy RetentionSort `json:"sort_by,omitempty"`
+	// OlderThan purges tags whose image was created longer ago than this duration, e.g. 720h
+	OlderThan string `json:"older_than,omitempty"`
+	// KeepAtLeast keeps the newest tags regardless of any purge criteria
+	KeepAtLeast *int64 `json:"keep_at_least,omitempty"`
 }
 
+// RetentionSort defines how the newest tags are determined
+type RetentionSort string
+
+const (
+	// RetentionSortSemver sorts tags by their semantic version
+	RetentionSortSemver = RetentionSort("semver")
+	// RetentionSortCreated sorts tags by the creation time in the image config,
+	// for multi-platform images the linux/amd64 image is used
+	RetentionSortCreated = RetentionSort("created")
+)
+
 func (c Config) Validate() error {
 	var errs []error
-	sources := make(map[string]bool)
-	destinations := make(map[string]bool)
-	for _, image := range c.Images {
-		if image.Source == "" {
-			errs = append(errs, fmt.Errorf("image.source is empty:%#v", image))
+	if err := c.checkHeader(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, c.mergeConflicts()...)
+	for name, registry := range c.Registries {
+		var registryErrs []error
+		if registry.Concurrency < 0 {
+			registryErrs = append(registryErrs, fmt.Errorf("registry.concurrency must not be negative, registry:%q", name))
 		}
-		if image.Destination == "" {
-			errs = append(errs, fmt.Errorf("image.destination is empty:%#v", image))
+		registryErrs = append(registryErrs, registry.Auth.validate(name)...)
+		errs = append(errs, inFile(c.registryOrigin(name), registryErrs)...)
+	}
+	errs = append(errs, c.unresolvedSecrets()...)
+	if c.Schedules != nil {
+		for name, schedule := range map[string]string{
+			"mirror":        c.Schedules.Mirror,
+			"purge":         c.Schedules.Purge,
+			"purge_unknown": c.Schedules.PurgeUnknown,
+		} {
+			if schedule == "" {
+				continue
+			}
+			if _, err := cron.ParseStandard(schedule); err != nil {
+				errs = append(errs, fmt.Errorf("schedules.%s is invalid, schedule:%q %w", name, schedule, err))
+			}
 		}
-
-		if ok := sources[image.Source]; !ok {
-			sources[image.Source] = true
-		} else {
-			errs = append(errs, fmt.Errorf("image source is duplicate:%q", image.Source))
+	}
+	if c.PurgeUnknown != nil {
+		for field, prefixes := range map[string][]string{
+			"repositories": c.PurgeUnknown.Repositories,
+			"protected":    c.PurgeUnknown.Protected,
+		} {
+			for _, prefix := range prefixes {
+				if prefix == "" || strings.Contains(prefix, "://") {
+					errs = append(errs, fmt.Errorf("purge_unknown.%s is invalid, must be a repository prefix without scheme, prefix:%q", field, prefix))
+				}
+			}
+		}
+		for _, exclude := range c.PurgeUnknown.Exclude {
+			if _, err := path.Match(exclude, ""); err != nil {
+				errs = append(errs, fmt.Errorf("purge_unknown.exclude is invalid, glob:%q %w", exclude, err))
+			}
+		}
+	}
+	// sources and destinations map to the file they were read from
+	sources := make(map[string]string)
+	destinations := make(map[string]string)
+	for _, entry := range c.Images {
+		var entryErrs []error
+		if entry.Source == "" {
+			entryErrs = append(entryErrs, fmt.Errorf("image.source is empty:%#v", entry))
+		}
+		if entry.Destination != "" && len(entry.Destinations) > 0 {
+			entryErrs = append(entryErrs, fmt.Errorf("image.destination and image.destinations cannot be set both, image source:%q", entry.Source))
 		}
 
-		if ok := destinations[image.Destination]; !ok {
-			destinations[image.Destination] = true
+		if origin, ok := sources[entry.Source]; !ok {
+			sources[entry.Source] = entry.origin
 		} else {
-			errs = append(errs, fmt.Errorf("image destination is duplicate:%q", image.Destination))
+			entryErrs = append(entryErrs, fmt.Errorf("image source is duplicate:%q%s", entry.Source, definedIn(origin)))
 		}
 
-		if ok := destinations[image.Source]; ok {
-			errs = append(errs, fmt.Errorf("image source is already specified as destination:%q", image.Source))
+		errs = append(errs, entry.locate(entryErrs)...)
+		for _, image := range entry.Mirrors() {
+			errs = append(errs, image.locate(image.validate(sources, destinations))...)
 		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// checkHeader checks apiVersion and kind, both may be empty for configs written before they were introduced
+func (c Config) checkHeader() error {
+	if c.APIVersion != "" && c.APIVersion != APIVersion {
+		return fmt.Errorf("apiVersion is not supported:%q, expected %q", c.APIVersion, APIVersion)
+	}
+	if c.Kind != "" && c.Kind != Kind {
+		return fmt.Errorf("kind is not supported:%q, expected %q", c.Kind, Kind)
+	}
+	return nil
+}
+
+// validate checks an image mirror with a single destination
+func (image ImageMirror) validate(sources, destinations map[string]string) []error {
+	var errs []error
+	if image.Destination == "" {
+		errs = append(errs, fmt.Errorf("image.destination is empty:%#v", image))
+	}
+
+	_, archivePath, archive := ParseArchive(image.Destination)
+	// several images can be written to the same archive
+	if origin, ok := destinations[image.Destination]; !ok || archive {
+		destinations[image.Destination] = image.origin
+	} else {
+		errs = append(errs, fmt.Errorf("image destination is duplicate:%q%s", image.Destination, definedIn(origin)))
+	}
+
+	if origin, ok := destinations[image.Source]; ok {
+		errs = append(errs, fmt.Errorf("image source is already specified as destination:%q%s", image.Source, definedIn(origin)))
+	}
+
+	if origin, ok := sources[image.Destination]; ok {
+		errs = append(errs, fmt.Errorf("image destination is already specified as source:%q%s", image.Destination, definedIn(origin)))
+	}
 
-		if ok := sources[image.Destination]; ok {
-			errs = append(errs, fmt.Errorf("image destination is already specified as source:%q", image.Destination))
+	if image.Source == image.Destination {
+		errs = append(errs, fmt.Errorf("source and destination are equal %q:%q", image.Source, image.Destination))
+	}
+
+	match := image.Match
+	if !match.AllTags && len(match.Tags) == 0 && match.Semver == nil && match.Last == nil && match.Regex == nil && match.Glob == nil {
+		errs = append(errs, fmt.Errorf("no image.match criteria given"))
+	}
+
+	if image.Match.Semver != nil {
+		if _, err := semver.NewConstraint(*image.Match.Semver); err != nil {
+			errs = append(errs, fmt.Errorf("image.match.semver is invalid, image source:%q, semver:%q %w", image.Source, *image.Match.Semver, err))
 		}
+	}
 
-		if image.Source == image.Destination {
-			errs = append(errs, fmt.Errorf("source and destination are equal %q:%q", image.Source, image.Destination))
+	errs = append(errs, validatePatterns("image.match", image.Source, image.Match.Regex, image.Match.Glob)...)
+
+	if exclude := image.Match.Exclude; exclude != nil {
+		if exclude.Semver != nil {
+			if _, err := semver.NewConstraint(*exclude.Semver); err != nil {
+				errs = append(errs, fmt.Errorf("image.match.exclude.semver is invalid, image source:%q, semver:%q %w", image.Source, *exclude.Semver, err))
+			}
 		}
+		errs = append(errs, validatePatterns("image.match.exclude", image.Source, exclude.Regex, exclude.Glob)...)
+	}
 
-		match := image.Match
-		if !match.AllTags && len(match.Tags) == 0 && match.Semver == nil && match.Last == nil {
-			errs = append(errs, fmt.Errorf("no image.match criteria given"))
+	for _, platform := range image.Platforms {
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("image.platforms is invalid, image source:%q, platform:%q %w", image.Source, platform, err))
+			continue
+		}
+		if p.OS == "" || p.Architecture == "" {
+			errs = append(errs, fmt.Errorf("image.platforms is invalid, must be os/arch[/variant], image source:%q, platform:%q", image.Source, platform))
 		}
+	}
+
+	switch image.Schema1 {
+	case "", Schema1Skip, Schema1Reject, Schema1Convert:
+	default:
+		errs = append(errs, fmt.Errorf("image.schema1 is invalid, must be one of skip, reject or convert, image source:%q, schema1:%q", image.Source, image.Schema1))
+	}
 
-		if image.Match.Semver != nil {
-			if _, err := semver.NewConstraint(*image.Match.Semver); err != nil {
-				errs = append(errs, fmt.Errorf("image.match.semver is invalid, image source:%q, semver:%q %w", image.Source, *image.Match.Semver, err))
+	if rewrite := image.Rewrite; rewrite != nil {
+		if rewrite.Regex != nil {
+			if _, err := regexp.Compile(*rewrite.Regex); err != nil {
+				errs = append(errs, fmt.Errorf("image.rewrite.regex is invalid, image source:%q, regex:%q %w", image.Source, *rewrite.Regex, err))
 			}
+		} else if rewrite.Replacement != "" {
+			errs = append(errs, fmt.Errorf("image.rewrite.replacement requires image.rewrite.regex, image source:%q", image.Source))
+		}
+		if _, err := name.NewTag("image:" + rewrite.Prefix + "0" + rewrite.Suffix); err != nil {
+			errs = append(errs, fmt.Errorf("image.rewrite prefix or suffix is invalid, image source:%q, prefix:%q, suffix:%q %w", image.Source, rewrite.Prefix, rewrite.Suffix, err))
 		}
+	}
 
-		if image.Purge != nil {
-			if image.Purge.Semver != nil {
-				if _, err := semver.NewConstraint(*image.Purge.Semver); err != nil {
-					errs = append(errs, fmt.Errorf("image.purge.semver is invalid, image source:%q, semver:%q %w", image.Source, *image.Purge.Semver, err))
-				}
-			}
-			if image.Purge.NoMatch && image.Match.AllTags {
-				errs = append(errs, fmt.Errorf("image.purge.nomatch and image.match.alltags cannot be set both image source:%q", image.Source))
+	switch image.MutableTags {
+	case "", MutableTagsAlways, MutableTagsOnChange, MutableTagsNever:
+	default:
+		errs = append(errs, fmt.Errorf("image.mutable_tags is invalid, must be one of always, on_change or never, image source:%q, mutable_tags:%q", image.Source, image.MutableTags))
+	}
+
+	if image.Purge != nil {
+		if image.Purge.Semver != nil {
+			if _, err := semver.NewConstraint(*image.Purge.Semver); err != nil {
+				errs = append(errs, fmt.Errorf("image.purge.semver is invalid, image source:%q, semver:%q %w", image.Source, *image.Purge.Semver, err))
 			}
 		}
+		errs = append(errs, validatePatterns("image.purge", image.Source, image.Purge.Regex, image.Purge.Glob)...)
+		if retention := image.Purge.Retention; retention != nil {
+			errs = append(errs, retention.validate(image.Source)...)
+		}
+		if image.Purge.NoMatch && image.Match.AllTags {
+			errs = append(errs, fmt.Errorf("image.purge.nomatch and image.match.alltags cannot be set both image source:%q", image.Source))
+		}
+	}
 
-		srcRef, err := name.ParseReference(image.Source)
-		if err != nil {
-			errs = append(errs, err)
-		} else {
-			if !strings.Contains(srcRef.Name(), ":latest") {
-				errs = append(errs, fmt.Errorf("image source contains a tag:%q", srcRef.Name()))
-			}
+	srcRef, err := name.ParseReference(image.Source)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		if !strings.Contains(srcRef.Name(), ":latest") {
+			errs = append(errs, fmt.Errorf("image source contains a tag:%q", srcRef.Name()))
+		}
+	}
+
+	if archive {
+		if !filepath.IsAbs(archivePath) {
+			errs = append(errs, fmt.Errorf("image destination archive path must be absolute, image source:%q, destination:%q", image.Source, image.Destination))
 		}
+		if image.Purge != nil {
+			errs = append(errs, fmt.Errorf("image.purge is not supported for archive destinations, image source:%q, destination:%q", image.Source, image.Destination))
+		}
+		if image.IncludeReferrers {
+			errs = append(errs, fmt.Errorf("image.include_referrers is not supported for archive destinations, image source:%q, destination:%q", image.Source, image.Destination))
+		}
+		return errs
+	}
 
-		if strings.HasPrefix(image.Destination, "http://") {
-			image.Destination = strings.ReplaceAll(image.Destination, "http://", "")
+	if strings.HasPrefix(image.Destination, "http://") {
+		image.Destination = strings.ReplaceAll(image.Destination, "http://", "")
+	}
+
+	dstRef, err := name.ParseReference(image.Destination)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		if !strings.Contains(dstRef.Name(), ":latest") {
+			errs = append(errs, fmt.Errorf("image destination contains a tag:%q", dstRef.Name()))
 		}
+	}
+
+	return errs
+}
 
-		dstRef, err := name.ParseReference(image.Destination)
+func (r *Retention) validate(source string) []error {
+	var errs []error
+	if r.KeepLast != nil && *r.KeepLast < 1 {
+		errs = append(errs, fmt.Errorf("image.purge.retention.keep_last must be positive, image source:%q", source))
+	}
+	if r.KeepAtLeast != nil && *r.KeepAtLeast < 0 {
+		errs = append(errs, fmt.Errorf("image.purge.retention.keep_at_least must not be negative, image source:%q", source))
+	}
+	switch r.SortBy {
+	case "", RetentionSortSemver, RetentionSortCreated:
+	default:
+		errs = append(errs, fmt.Errorf("image.purge.retention.sort_by is invalid, must be one of semver or created, image source:%q, sort_by:%q", source, r.SortBy))
+	}
+	if r.OlderThan != "" {
+		d, err := time.ParseDuration(r.OlderThan)
 		if err != nil {
-			errs = append(errs, err)
-		} else {
-			if !strings.Contains(dstRef.Name(), ":latest") {
-				errs = append(errs, fmt.Errorf("image destination contains a tag:%q", dstRef.Name()))
-			}
+			errs = append(errs, fmt.Errorf("image.purge.retention.older_than is invalid, image source:%q, older_than:%q %w", source, r.OlderThan, err))
+		} else if d <= 0 {
+			errs = append(errs, fmt.Errorf("image.purge.retention.older_than must be positive, image source:%q, older_than:%q", source, r.OlderThan))
 		}
 	}
+	return errs
+}
 
-	if len(errs) > 0 {
-		return errors.Join(errs...)
+// validatePatterns checks the regular expression and glob of a match or purge specification
+func validatePatterns(field, source string, regex, glob *string) []error {
+	var errs []error
+	if regex != nil {
+		if _, err := regexp.Compile(*regex); err != nil {
+			errs = append(errs, fmt.Errorf("%s.regex is invalid, image source:%q, regex:%q %w", field, source, *regex, err))
+		}
 	}
-	return nil
+	if glob != nil {
+		if _, err := path.Match(*glob, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%s.glob is invalid, image source:%q, glob:%q %w", field, source, *glob, err))
+		}
+	}
+	return errs
 }
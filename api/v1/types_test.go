@@ -7,11 +7,40 @@ import (
 func TestConfig_Validate(t *testing.T) {
 
 	tests := []struct {
-		name       string
-		Images     []ImageMirror
-		Registries map[string]Registry
-		wantErr    bool
+		name         string
+		APIVersion   string
+		Kind         string
+		Images       []ImageMirror
+		Registries   map[string]Registry
+		Schedules    *Schedules
+		PurgeUnknown *PurgeUnknown
+		wantErr      bool
 	}{
+		{
+			name:       "valid api version and kind",
+			APIVersion: APIVersion,
+			Kind:       Kind,
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			wantErr: false,
+		},
+		{
+			name:       "unsupported api version",
+			APIVersion: "oci-mirror.metal-stack.io/v0",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsupported kind",
+			Kind: "Mirror",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			wantErr: true,
+		},
 		{
 			name: "duplicate source",
 			Images: []ImageMirror{
@@ -135,12 +164,337 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "negative registry concurrency",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			Registries: map[string]Registry{
+				"cde": {Concurrency: -1},
+			},
+			wantErr: true,
+		},
+		{
+			name: "registry auth with tokens",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			Registries: map[string]Registry{
+				"cde": {Auth: RegistryAuth{Username: "<token>", IdentityToken: "refresh"}},
+				"abc": {Auth: RegistryAuth{RegistryToken: "bearer"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "registry auth with docker config and credential helper",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			Registries: map[string]Registry{
+				"cde": {Auth: RegistryAuth{DockerConfig: "/root/.docker/config.json"}},
+				"abc": {Auth: RegistryAuth{CredentialHelper: "ecr-login"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "registry auth with several sources",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			Registries: map[string]Registry{
+				"cde": {Auth: RegistryAuth{Username: "user", Password: "secret", DockerConfig: "/root/.docker/config.json"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "registry auth password without username",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			Registries: map[string]Registry{
+				"cde": {Auth: RegistryAuth{Password: "secret"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "registry auth credential helper path",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			Registries: map[string]Registry{
+				"cde": {Auth: RegistryAuth{CredentialHelper: "/usr/bin/docker-credential-ecr-login"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid schedules",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			Schedules: &Schedules{
+				Mirror:       "*/20 * * * *",
+				PurgeUnknown: "@weekly",
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid schedule",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			Schedules: &Schedules{
+				Purge: "every 20 minutes",
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid platforms",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}, Platforms: []string{"linux/amd64", "linux/arm64/v8"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "platform without architecture",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}, Platforms: []string{"linux"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "platform with too many slashes",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}, Platforms: []string{"linux/arm64/v8/foo"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid schema1 policy",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}, Schema1: Schema1Convert},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid schema1 policy",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}, Schema1: "ignore"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid regex and glob",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Regex: new(`^v1\.2[0-9]\..*-debian$`), Glob: new("*-alpine")}, Purge: &Purge{Regex: new("-rc[0-9]+$"), Glob: new("*-debug")}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid match regex",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Regex: new("v1.(")}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid match glob",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Glob: new("[-alpine")}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid purge regex",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}, Purge: &Purge{Regex: new("*-rc")}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid exclude",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Semver: new(">= 1.35"), IncludePrereleases: true, Exclude: &Exclude{Tags: []string{"1.36.0"}, Semver: new("< 1.36"), Regex: new("-debug$"), Glob: new("*-rc*")}}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "exclude is not a match criteria",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Exclude: &Exclude{Tags: []string{"1.36.0"}}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid exclude semver",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{AllTags: true, Exclude: &Exclude{Semver: new("1.a")}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid exclude regex",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{AllTags: true, Exclude: &Exclude{Regex: new("(")}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid rewrite",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{AllTags: true}, Rewrite: &TagRewrite{Regex: new("^v(.*)$"), Replacement: "$1", Prefix: "upstream-", Suffix: "-mirror"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid rewrite regex",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{AllTags: true}, Rewrite: &TagRewrite{Regex: new("^v(")}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rewrite replacement without regex",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{AllTags: true}, Rewrite: &TagRewrite{Replacement: "$1"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid rewrite prefix",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{AllTags: true}, Rewrite: &TagRewrite{Prefix: "-up/"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid destinations",
+			Images: []ImageMirror{
+				{Source: "abc", Match: Match{AllTags: true}, Destinations: []Destination{
+					{Destination: "cde"},
+					{Destination: "http://efg", Match: &Match{Tags: []string{"1.0"}}, Purge: &Purge{Tags: []string{"0.9"}}, Platforms: []string{"linux/amd64"}},
+				}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "destination and destinations",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{AllTags: true}, Destinations: []Destination{{Destination: "efg"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate destinations",
+			Images: []ImageMirror{
+				{Source: "abc", Match: Match{AllTags: true}, Destinations: []Destination{{Destination: "cde"}, {Destination: "cde"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid destination override",
+			Images: []ImageMirror{
+				{Source: "abc", Match: Match{AllTags: true}, Destinations: []Destination{{Destination: "cde", Match: &Match{}}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid purge unknown",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			PurgeUnknown: &PurgeUnknown{Repositories: []string{"r.example.com/library/"}, Protected: []string{"r.example.com/library/keep"}, Exclude: []string{"r.example.com/*/cache"}},
+			wantErr:      false,
+		},
+		{
+			name: "purge unknown repository with scheme",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			PurgeUnknown: &PurgeUnknown{Repositories: []string{"http://r.example.com/library/"}},
+			wantErr:      true,
+		},
+		{
+			name: "invalid purge unknown exclude",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}},
+			},
+			PurgeUnknown: &PurgeUnknown{Exclude: []string{"r.example.com/[/cache"}},
+			wantErr:      true,
+		},
+		{
+			name: "valid retention",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{AllTags: true}, Purge: &Purge{Retention: &Retention{KeepLast: new(int64(10)), SortBy: RetentionSortCreated, OlderThan: "720h", KeepAtLeast: new(int64(3))}}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid retention",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{AllTags: true}, Purge: &Purge{Retention: &Retention{KeepLast: new(int64(0)), SortBy: "name", OlderThan: "30d", KeepAtLeast: new(int64(-1))}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative retention duration",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{AllTags: true}, Purge: &Purge{Retention: &Retention{OlderThan: "-1h"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid mutable tags policy",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}, MutableTags: MutableTagsNever},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid mutable tags policy",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "cde", Match: Match{Tags: []string{"latest"}}, MutableTags: "sometimes"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "several images to the same archive",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "oci-layout:///var/lib/mirror", Match: Match{AllTags: true}},
+				{Source: "def", Destinations: []Destination{{Destination: "oci-layout:///var/lib/mirror"}, {Destination: "tar:///var/lib/mirror.tar"}}, Match: Match{Tags: []string{"1.0"}}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "relative archive path",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "tar://mirror.tar", Match: Match{AllTags: true}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "referrers of an archive",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "oci-layout:///var/lib/mirror", Match: Match{AllTags: true}, IncludeReferrers: true},
+			},
+			wantErr: true,
+		},
+		{
+			name: "purge of an archive",
+			Images: []ImageMirror{
+				{Source: "abc", Destination: "oci-layout:///var/lib/mirror", Match: Match{AllTags: true}, Purge: &Purge{Tags: []string{"1.0"}}},
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			c := Config{
-				Images:     tt.Images,
-				Registries: tt.Registries,
+				APIVersion:   tt.APIVersion,
+				Kind:         tt.Kind,
+				Images:       tt.Images,
+				Registries:   tt.Registries,
+				Schedules:    tt.Schedules,
+				PurgeUnknown: tt.PurgeUnknown,
 			}
 			if err := c.Validate(); (err != nil) != tt.wantErr {
 				t.Errorf("Config.Destination() error = %v, wantErr %v", err, tt.wantErr)
@@ -0,0 +1,267 @@
+package v2
+
+import (
+	"slices"
+
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+)
+
+// FromV1 converts a v1 config to v2, the destination of an image becomes its only destination
+func FromV1(c apiv1.Config) Config {
+	converted := Config{
+		APIVersion:   APIVersion,
+		Kind:         Kind,
+		Schedules:    convertPointer(c.Schedules, schedulesFromV1),
+		PurgeUnknown: convertPointer(c.PurgeUnknown, purgeUnknownFromV1),
+	}
+	if c.Registries != nil {
+		converted.Registries = make(map[string]Registry, len(c.Registries))
+		for name, registry := range c.Registries {
+			converted.Registries[name] = Registry{Auth: registryAuthFromV1(registry.Auth), Concurrency: registry.Concurrency}
+		}
+	}
+	for _, image := range c.Images {
+		var destinations []Destination
+		if image.Destination != "" {
+			destinations = append(destinations, Destination{Destination: image.Destination})
+		}
+		for _, d := range image.Destinations {
+			destinations = append(destinations, destinationFromV1(d))
+		}
+		converted.Images = append(converted.Images, ImageMirror{
+			Source:           image.Source,
+			Destinations:     destinations,
+			Match:            matchFromV1(image.Match),
+			Purge:            convertPointer(image.Purge, purgeFromV1),
+			Platforms:        slices.Clone(image.Platforms),
+			Schema1:          Schema1Policy(image.Schema1),
+			MutableTags:      MutableTagsPolicy(image.MutableTags),
+			Rewrite:          convertPointer(image.Rewrite, tagRewriteFromV1),
+			IncludeReferrers: image.IncludeReferrers,
+		})
+	}
+	return converted
+}
+
+// ToV1 converts the config to v1. A single destination without overrides is written as destination,
+// several destinations or destinations with overrides as destinations.
+func (c Config) ToV1() apiv1.Config {
+	converted := apiv1.Config{
+		APIVersion:   apiv1.APIVersion,
+		Kind:         apiv1.Kind,
+		Schedules:    convertPointer(c.Schedules, Schedules.toV1),
+		PurgeUnknown: convertPointer(c.PurgeUnknown, PurgeUnknown.toV1),
+	}
+	if c.Registries != nil {
+		converted.Registries = make(map[string]apiv1.Registry, len(c.Registries))
+		for name, registry := range c.Registries {
+			converted.Registries[name] = apiv1.Registry{Auth: registry.Auth.toV1(), Concurrency: registry.Concurrency}
+		}
+	}
+	for _, image := range c.Images {
+		mirror := apiv1.ImageMirror{
+			Source:           image.Source,
+			Match:            image.Match.toV1(),
+			Purge:            convertPointer(image.Purge, Purge.toV1),
+			Platforms:        slices.Clone(image.Platforms),
+			Schema1:          apiv1.Schema1Policy(image.Schema1),
+			MutableTags:      apiv1.MutableTagsPolicy(image.MutableTags),
+			Rewrite:          convertPointer(image.Rewrite, TagRewrite.toV1),
+			IncludeReferrers: image.IncludeReferrers,
+		}
+		if len(image.Destinations) == 1 && !hasOverrides(image.Destinations[0]) {
+			mirror.Destination = image.Destinations[0].Destination
+		} else {
+			for _, d := range image.Destinations {
+				mirror.Destinations = append(mirror.Destinations, d.toV1())
+			}
+		}
+		converted.Images = append(converted.Images, mirror)
+	}
+	return converted
+}
+
+// hasOverrides returns true if the destination overrides settings of the image
+func hasOverrides(d Destination) bool {
+	return d.Match != nil || d.Purge != nil || d.Platforms != nil
+}
+
+// convertPointer converts the value of p, nil stays nil
+func convertPointer[From, To any](p *From, convert func(From) To) *To {
+	if p == nil {
+		return nil
+	}
+	converted := convert(*p)
+	return &converted
+}
+
+// clonePointer copies the value of p, so that the converted config does not share it
+func clonePointer[T any](p *T) *T {
+	return convertPointer(p, func(v T) T { return v })
+}
+
+func destinationFromV1(d apiv1.Destination) Destination {
+	return Destination{
+		Destination: d.Destination,
+		Match:       convertPointer(d.Match, matchFromV1),
+		Purge:       convertPointer(d.Purge, purgeFromV1),
+		Platforms:   slices.Clone(d.Platforms),
+	}
+}
+
+func (d Destination) toV1() apiv1.Destination {
+	return apiv1.Destination{
+		Destination: d.Destination,
+		Match:       convertPointer(d.Match, Match.toV1),
+		Purge:       convertPointer(d.Purge, Purge.toV1),
+		Platforms:   slices.Clone(d.Platforms),
+	}
+}
+
+func matchFromV1(m apiv1.Match) Match {
+	return Match{
+		AllTags:            m.AllTags,
+		Tags:               slices.Clone(m.Tags),
+		Semver:             clonePointer(m.Semver),
+		Regex:              clonePointer(m.Regex),
+		Glob:               clonePointer(m.Glob),
+		Last:               clonePointer(m.Last),
+		IncludePrereleases: m.IncludePrereleases,
+		Exclude:            convertPointer(m.Exclude, excludeFromV1),
+	}
+}
+
+func (m Match) toV1() apiv1.Match {
+	return apiv1.Match{
+		AllTags:            m.AllTags,
+		Tags:               slices.Clone(m.Tags),
+		Semver:             clonePointer(m.Semver),
+		Regex:              clonePointer(m.Regex),
+		Glob:               clonePointer(m.Glob),
+		Last:               clonePointer(m.Last),
+		IncludePrereleases: m.IncludePrereleases,
+		Exclude:            convertPointer(m.Exclude, Exclude.toV1),
+	}
+}
+
+func excludeFromV1(e apiv1.Exclude) Exclude {
+	return Exclude{
+		Tags:   slices.Clone(e.Tags),
+		Semver: clonePointer(e.Semver),
+		Regex:  clonePointer(e.Regex),
+		Glob:   clonePointer(e.Glob),
+	}
+}
+
+func (e Exclude) toV1() apiv1.Exclude {
+	return apiv1.Exclude{
+		Tags:   slices.Clone(e.Tags),
+		Semver: clonePointer(e.Semver),
+		Regex:  clonePointer(e.Regex),
+		Glob:   clonePointer(e.Glob),
+	}
+}
+
+func purgeFromV1(p apiv1.Purge) Purge {
+	return Purge{
+		Tags:      slices.Clone(p.Tags),
+		Semver:    clonePointer(p.Semver),
+		Regex:     clonePointer(p.Regex),
+		Glob:      clonePointer(p.Glob),
+		NoMatch:   p.NoMatch,
+		Retention: convertPointer(p.Retention, retentionFromV1),
+	}
+}
+
+func (p Purge) toV1() apiv1.Purge {
+	return apiv1.Purge{
+		Tags:      slices.Clone(p.Tags),
+		Semver:    clonePointer(p.Semver),
+		Regex:     clonePointer(p.Regex),
+		Glob:      clonePointer(p.Glob),
+		NoMatch:   p.NoMatch,
+		Retention: convertPointer(p.Retention, Retention.toV1),
+	}
+}
+
+func retentionFromV1(r apiv1.Retention) Retention {
+	return Retention{
+		KeepLast:    clonePointer(r.KeepLast),
+		SortBy:      RetentionSort(r.SortBy),
+		OlderThan:   r.OlderThan,
+		KeepAtLeast: clonePointer(r.KeepAtLeast),
+	}
+}
+
+func (r Retention) toV1() apiv1.Retention {
+	return apiv1.Retention{
+		KeepLast:    clonePointer(r.KeepLast),
+		SortBy:      apiv1.RetentionSort(r.SortBy),
+		OlderThan:   r.OlderThan,
+		KeepAtLeast: clonePointer(r.KeepAtLeast),
+	}
+}
+
+func tagRewriteFromV1(r apiv1.TagRewrite) TagRewrite {
+	return TagRewrite{
+		Regex:       clonePointer(r.Regex),
+		Replacement: r.Replacement,
+		Prefix:      r.Prefix,
+		Suffix:      r.Suffix,
+	}
+}
+
+func (r TagRewrite) toV1() apiv1.TagRewrite {
+	return apiv1.TagRewrite{
+		Regex:       clonePointer(r.Regex),
+		Replacement: r.Replacement,
+		Prefix:      r.Prefix,
+		Suffix:      r.Suffix,
+	}
+}
+
+func registryAuthFromV1(a apiv1.RegistryAuth) RegistryAuth {
+	return RegistryAuth{
+		Username:         a.Username,
+		Password:         a.Password,
+		IdentityToken:    a.IdentityToken,
+		RegistryToken:    a.RegistryToken,
+		DockerConfig:     a.DockerConfig,
+		CredentialHelper: a.CredentialHelper,
+	}
+}
+
+func (a RegistryAuth) toV1() apiv1.RegistryAuth {
+	return apiv1.RegistryAuth{
+		Username:         a.Username,
+		Password:         a.Password,
+		IdentityToken:    a.IdentityToken,
+		RegistryToken:    a.RegistryToken,
+		DockerConfig:     a.DockerConfig,
+		CredentialHelper: a.CredentialHelper,
+	}
+}
+
+func schedulesFromV1(s apiv1.Schedules) Schedules {
+	return Schedules{Mirror: s.Mirror, Purge: s.Purge, PurgeUnknown: s.PurgeUnknown}
+}
+
+func (s Schedules) toV1() apiv1.Schedules {
+	return apiv1.Schedules{Mirror: s.Mirror, Purge: s.Purge, PurgeUnknown: s.PurgeUnknown}
+}
+
+func purgeUnknownFromV1(p apiv1.PurgeUnknown) PurgeUnknown {
+	return PurgeUnknown{
+		Repositories: slices.Clone(p.Repositories),
+		Protected:    slices.Clone(p.Protected),
+		Exclude:      slices.Clone(p.Exclude),
+	}
+}
+
+func (p PurgeUnknown) toV1() apiv1.PurgeUnknown {
+	return apiv1.PurgeUnknown{
+		Repositories: slices.Clone(p.Repositories),
+		Protected:    slices.Clone(p.Protected),
+		Exclude:      slices.Clone(p.Exclude),
+	}
+}
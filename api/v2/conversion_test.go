@@ -0,0 +1,201 @@
+package v2
+
+import (
+	"reflect"
+	"testing"
+
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConversionRoundTrip(t *testing.T) {
+	v1 := apiv1.Config{
+		APIVersion: apiv1.APIVersion,
+		Kind:       apiv1.Kind,
+		Registries: map[string]apiv1.Registry{
+			"r.example.com": {Auth: apiv1.RegistryAuth{Username: "user", Password: "${REGISTRY_PASSWORD}"}, Concurrency: 2},
+		},
+		Schedules:    &apiv1.Schedules{Mirror: "@hourly"},
+		PurgeUnknown: &apiv1.PurgeUnknown{Repositories: []string{"r.example.com/library/"}},
+		Images: []apiv1.ImageMirror{
+			{
+				Source:           "alpine",
+				Destination:      "r.example.com/library/alpine",
+				Match:            apiv1.Match{Semver: new(">= 3.19")},
+				Purge:            &apiv1.Purge{NoMatch: true},
+				Platforms:        []string{"linux/amd64"},
+				Schema1:          apiv1.Schema1Skip,
+				MutableTags:      apiv1.MutableTagsNever,
+				Rewrite:          &apiv1.TagRewrite{Suffix: "-mirror"},
+				IncludeReferrers: true,
+			},
+			{
+				Source: "busybox",
+				Destinations: []apiv1.Destination{
+					{Destination: "r.example.com/library/busybox"},
+					{Destination: "r2.example.com/library/busybox", Match: &apiv1.Match{Tags: []string{"1.36"}}},
+				},
+				Match: apiv1.Match{AllTags: true},
+			},
+			{
+				Source:       "debian",
+				Destinations: []apiv1.Destination{{Destination: "r.example.com/library/debian", Platforms: []string{"linux/arm64"}}},
+				Match:        apiv1.Match{Tags: []string{"12"}},
+			},
+		},
+	}
+	checked := v1
+	checked.KeepSecretReferences()
+	require.NoError(t, checked.Validate())
+
+	v2 := FromV1(v1)
+	require.Equal(t, APIVersion, v2.APIVersion)
+	require.Equal(t, Kind, v2.Kind)
+	require.Equal(t, []Destination{{Destination: "r.example.com/library/alpine"}}, v2.Images[0].Destinations)
+	require.Equal(t, []Destination{
+		{Destination: "r.example.com/library/busybox"},
+		{Destination: "r2.example.com/library/busybox", Match: &Match{Tags: []string{"1.36"}}},
+	}, v2.Images[1].Destinations)
+
+	require.Equal(t, v1, v2.ToV1())
+	require.Equal(t, v2, FromV1(v2.ToV1()))
+}
+
+func TestConversionCoversAllFields(t *testing.T) {
+	var v1 apiv1.Config
+	fill(reflect.ValueOf(&v1).Elem())
+	v1.APIVersion = apiv1.APIVersion
+	v1.Kind = apiv1.Kind
+	// the destination of v1 is converted to a destination without overrides, which is covered by TestConversionRoundTrip
+	v1.Images[0].Destination = ""
+
+	// a field which is added to v1 but not to v2 or not converted is lost on the way back
+	require.Equal(t, v1, FromV1(v1).ToV1())
+}
+
+// fill sets every exported field of v to a non-zero value, slices and maps get a single element
+func fill(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				fill(v.Field(i))
+			}
+		}
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fill(v.Elem())
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fill(v.Index(0))
+	case reflect.Map:
+		key := reflect.New(v.Type().Key()).Elem()
+		fill(key)
+		value := reflect.New(v.Type().Elem()).Elem()
+		fill(value)
+		v.Set(reflect.MakeMap(v.Type()))
+		v.SetMapIndex(key, value)
+	case reflect.String:
+		v.SetString("value")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(1)
+	default:
+		panic("fill does not support " + v.Kind().String())
+	}
+}
+
+func TestToV1(t *testing.T) {
+	v2 := Config{
+		APIVersion: APIVersion,
+		Kind:       Kind,
+		Images: []ImageMirror{
+			{Source: "alpine", Destinations: []Destination{{Destination: "r.example.com/library/alpine"}}, Match: Match{AllTags: true}},
+			{Source: "busybox", Match: Match{AllTags: true}},
+		},
+	}
+	v1 := v2.ToV1()
+	require.Equal(t, "r.example.com/library/alpine", v1.Images[0].Destination)
+	require.Nil(t, v1.Images[0].Destinations)
+
+	// an image without destinations is rejected by the validation of v1
+	require.ErrorContains(t, v1.Validate(), "image.destination is empty")
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		want     []apiv1.ImageMirror
+		wantErrs []string
+	}{
+		{
+			name: "valid",
+			raw: `
+apiVersion: oci-mirror.metal-stack.io/v2
+kind: MirrorConfig
+images:
+  - source: alpine
+    destinations:
+      - destination: r.example.com/library/alpine
+    match:
+      all_tags: true
+`,
+			want: []apiv1.ImageMirror{
+				{Source: "alpine", Destination: "r.example.com/library/alpine", Match: apiv1.Match{AllTags: true}},
+			},
+		},
+		{
+			name: "single destination of v1",
+			raw: `
+apiVersion: oci-mirror.metal-stack.io/v2
+kind: MirrorConfig
+images:
+  - source: alpine
+    destination: r.example.com/library/alpine
+    match:
+      all_tags: true
+`,
+			wantErrs: []string{`unknown key "destination" in images[0], file:"main.yaml:6"`},
+		},
+		{
+			name: "missing kind",
+			raw: `
+apiVersion: oci-mirror.metal-stack.io/v2
+images: []
+`,
+			wantErrs: []string{`apiVersion and kind must be "oci-mirror.metal-stack.io/v2" and "MirrorConfig", got "oci-mirror.metal-stack.io/v2" and ""`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseConfig("main.yaml", []byte(tt.raw))
+			if len(tt.wantErrs) > 0 {
+				for _, want := range tt.wantErrs {
+					require.ErrorContains(t, err, want)
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, got.Validate())
+			require.Len(t, got.Images, len(tt.want))
+			for i := range tt.want {
+				require.Equal(t, tt.want[i].Mirrors()[0].Destination, got.Images[i].Destination)
+				require.Equal(t, tt.want[i].Match, got.Images[i].Match)
+			}
+		})
+	}
+
+	// validation errors report the line of the v2 image
+	got, err := ParseConfig("main.yaml", []byte(`
+apiVersion: oci-mirror.metal-stack.io/v2
+kind: MirrorConfig
+images:
+  - source: alpine
+    destinations:
+      - destination: r.example.com/library/alpine
+`))
+	require.NoError(t, err)
+	require.ErrorContains(t, got.Validate(), `no image.match criteria given, file:"main.yaml:5"`)
+}
@@ -0,0 +1,258 @@
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+)
+
+const (
+	// APIVersion is the apiVersion of this config version
+	APIVersion = apiv1.Group + "/v2"
+	// Kind is the kind of the config
+	Kind = apiv1.Kind
+)
+
+// Config defines which images should be mirrored.
+// Compared to v1 every image lists its destinations in destinations, the single destination of v1 is gone.
+type Config struct {
+	// APIVersion must be oci-mirror.metal-stack.io/v2
+	APIVersion string `json:"apiVersion"`
+	// Kind must be MirrorConfig
+	Kind string `json:"kind"`
+	// Images is a list of repositories to mirror
+	Images []ImageMirror `json:"images,omitempty"`
+	// Registries defines source and destination registries with authentication
+	Registries map[string]Registry `json:"registries,omitempty"`
+	// Schedules defines when mirror, purge and purge-unknown run in daemon mode
+	Schedules *Schedules `json:"schedules,omitempty"`
+	// PurgeUnknown restricts purge-unknown to some repositories of the destination registries,
+	// all unknown tags of all destination registries are purged if not set.
+	PurgeUnknown *PurgeUnknown `json:"purge_unknown,omitempty"`
+}
+
+// ImageMirror defines the mirror configuration for a single Repo
+type ImageMirror struct {
+	// Source defines from which repo the images should pulled from
+	Source string `json:"source,omitempty"`
+	// Destinations are the image repos the Source is mirrored to, the source tags and manifests are only read once.
+	// Every destination can override Match, Purge and Platforms.
+	Destinations []Destination `json:"destinations,omitempty"`
+	// Match defines which images to mirror
+	Match Match `json:"match"`
+	// Purge defines which images should be purged
+	Purge *Purge `json:"purge,omitempty"`
+	// Platforms restricts multi-platform images to the given platforms, e.g. linux/amd64 or linux/arm64.
+	Platforms []string `json:"platforms,omitempty"`
+	// Schema1 defines how deprecated Docker v2 schema 1 manifests are handled, can be skip, reject or convert.
+	Schema1 Schema1Policy `json:"schema1,omitempty"`
+	// MutableTags defines when tags which already exist in the destination are overwritten, can be always, on_change or never.
+	MutableTags MutableTagsPolicy `json:"mutable_tags,omitempty"`
+	// Rewrite transforms the source tags into the destination tags, tags are mirrored unchanged if not set.
+	Rewrite *TagRewrite `json:"rewrite,omitempty"`
+	// IncludeReferrers mirrors the signatures, attestations and SBOMs of every mirrored digest as well.
+	IncludeReferrers bool `json:"include_referrers,omitempty"`
+}
+
+// The types below have the same fields as in v1, they are converted field by field in conversion.go.
+
+// Destination is one of several destinations of an image mirror
+type Destination struct {
+	// Destination defines the new image repo the Source should be rewritten
+	// If prefixed with http:// insecure registry is considered, if prefixed with oci-layout:// or tar:// it is an archive on disk
+	Destination string `json:"destination,omitempty"`
+	// Match overrides the match of the image mirror for this destination
+	Match *Match `json:"match,omitempty"`
+	// Purge overrides the purge of the image mirror for this destination
+	Purge *Purge `json:"purge,omitempty"`
+	// Platforms overrides the platforms of the image mirror for this destination
+	Platforms []string `json:"platforms,omitempty"`
+}
+
+type Match struct {
+	// AllTags copies all images if true
+	AllTags bool `json:"all_tags,omitempty"`
+	// Tags is a exact list of tags to mirror from
+	Tags []string `json:"tags,omitempty"`
+	// Semver defines a semantic version of tags to mirror
+	Semver *string `json:"semver,omitempty"`
+	// Regex defines a regular expression of tags to mirror, it is not anchored unless ^ and $ are given
+	Regex *string `json:"regex,omitempty"`
+	// Glob defines a shell pattern of tags to mirror, e.g. *-alpine
+	Glob *string `json:"glob,omitempty"`
+	// Last defines how many of the latest tags should be mirrored
+	Last *int64 `json:"last,omitempty"`
+	// IncludePrereleases if set to true, Semver also matches pre-release tags like 1.36.0-rc1,
+	// otherwise they are only matched if the constraint contains a pre-release itself.
+	IncludePrereleases bool `json:"include_prereleases,omitempty"`
+	// Exclude removes tags matched by AllTags, Semver, Regex, Glob and Last, it is applied before the last tags are selected.
+	// Tags which are listed explicitly in Tags are never excluded.
+	Exclude *Exclude `json:"exclude,omitempty"`
+}
+
+// Exclude defines tags which must not be mirrored
+type Exclude struct {
+	// Tags is a exact list of tags to exclude
+	Tags []string `json:"tags,omitempty"`
+	// Semver defines a semantic version of tags to exclude, pre-release tags are matched regardless of IncludePrereleases
+	Semver *string `json:"semver,omitempty"`
+	// Regex defines a regular expression of tags to exclude, it is not anchored unless ^ and $ are given
+	Regex *string `json:"regex,omitempty"`
+	// Glob defines a shell pattern of tags to exclude, e.g. *-debug
+	Glob *string `json:"glob,omitempty"`
+}
+
+type Purge struct {
+	// Tags is a exact list of tags to purge
+	Tags []string `json:"tags,omitempty"`
+	// Semver defines a semantic version of tags to purge
+	Semver *string `json:"semver,omitempty"`
+	// Regex defines a regular expression of tags to purge, it is not anchored unless ^ and $ are given
+	Regex *string `json:"regex,omitempty"`
+	// Glob defines a shell pattern of tags to purge, e.g. *-debug
+	Glob *string `json:"glob,omitempty"`
+	// NoMatch if set to true, all images which are not matched by the Match specification will be purged.
+	// latest will never be purged
+	NoMatch bool `json:"no_match,omitempty"`
+	// Retention purges tags by their age or their number
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+// Retention defines which tags are kept by their age or their number, the other purge criteria still apply
+type Retention struct {
+	// KeepLast keeps the newest tags, older tags are purged
+	KeepLast *int64 `json:"keep_last,omitempty"`
+	// SortBy defines how the newest tags are determined, can be semver or created. Defaults to semver.
+	// Tags which are no semantic version are never purged by KeepLast if sorted by semver.
+	SortBy RetentionSort `json:"sort_by,omitempty"`
+	// OlderThan purges tags whose image was created longer ago than this duration, e.g. 720h
+	OlderThan string `json:"older_than,omitempty"`
+	// KeepAtLeast keeps the newest tags regardless of any purge criteria
+	KeepAtLeast *int64 `json:"keep_at_least,omitempty"`
+}
+
+// RetentionSort defines how the newest tags are determined
+type RetentionSort string
+
+const (
+	// RetentionSortSemver sorts tags by their semantic version
+	RetentionSortSemver = RetentionSort("semver")
+	// RetentionSortCreated sorts tags by the creation time in the image config,
+	// for multi-platform images the linux/amd64 image is used
+	RetentionSortCreated = RetentionSort("created")
+)
+
+// TagRewrite transforms a source tag into a destination tag, the regular expression is replaced first,
+// then prefix and suffix are added, e.g. regex "^v(.*)$" with replacement "$1" rewrites v1.2.3 to 1.2.3.
+type TagRewrite struct {
+	// Regex is replaced by Replacement in the source tag, tags which do not match are not replaced
+	Regex *string `json:"regex,omitempty"`
+	// Replacement replaces the matches of Regex, it can refer to capture groups with $1 or ${name}
+	Replacement string `json:"replacement,omitempty"`
+	// Prefix is prepended to the tag
+	Prefix string `json:"prefix,omitempty"`
+	// Suffix is appended to the tag
+	Suffix string `json:"suffix,omitempty"`
+}
+
+// Schema1Policy defines how deprecated Docker v2 schema 1 manifests are handled
+type Schema1Policy string
+
+const (
+	// Schema1Skip ignores schema 1 images with a warning
+	Schema1Skip = Schema1Policy("skip")
+	// Schema1Reject fails the mirror of schema 1 images
+	Schema1Reject = Schema1Policy("reject")
+	// Schema1Convert converts schema 1 images to Docker v2 schema 2 images
+	Schema1Convert = Schema1Policy("convert")
+)
+
+// MutableTagsPolicy defines when tags which already exist in the destination are overwritten
+type MutableTagsPolicy string
+
+const (
+	// MutableTagsAlways copies every tag, regardless if it changed
+	MutableTagsAlways = MutableTagsPolicy("always")
+	// MutableTagsOnChange copies a tag if its digest differs from the destination,
+	// the source digest is read with a HEAD request which does not count against pull rate limits
+	MutableTagsOnChange = MutableTagsPolicy("on_change")
+	// MutableTagsNever never overwrites a tag which already exists in the destination
+	MutableTagsNever = MutableTagsPolicy("never")
+)
+
+// Registry defines a source or destination registry which requires authentication
+type Registry struct {
+	Auth RegistryAuth `json:"auth"`
+	// Concurrency limits the number of concurrent image copies to this registry if mirroring runs concurrently
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// RegistryAuth is the authentication for a registry.
+// Either username, password and tokens, a docker config or a credential helper can be configured,
+// registries without auth use the default docker keychain of the environment.
+type RegistryAuth struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// IdentityToken is an OAuth2 refresh token which is exchanged for a registry token
+	IdentityToken string `json:"identity_token,omitempty"`
+	// RegistryToken is a bearer token which is sent to the registry as is
+	RegistryToken string `json:"registry_token,omitempty"`
+	// DockerConfig is the path to a docker config.json, the credentials of the registry are read from its auths,
+	// credsStore or credHelpers. It is a path and cannot reference secrets.
+	DockerConfig string `json:"docker_config,omitempty"`
+	// CredentialHelper is the name of a docker credential helper, e.g. ecr-login for the docker-credential-ecr-login binary in the PATH
+	CredentialHelper string `json:"credential_helper,omitempty"`
+}
+
+// String redacts the password and tokens
+func (a RegistryAuth) String() string {
+	return a.toV1().String()
+}
+
+// GoString redacts the password and tokens in %#v
+func (a RegistryAuth) GoString() string {
+	return a.toV1().GoString()
+}
+
+// LogValue redacts the password and tokens in logs
+func (a RegistryAuth) LogValue() slog.Value {
+	return a.toV1().LogValue()
+}
+
+// Schedules defines cron-style schedules, e.g. "*/20 * * * *", of the runs in daemon mode
+// An empty schedule disables the run.
+type Schedules struct {
+	// Mirror is the schedule of the mirror run
+	Mirror string `json:"mirror,omitempty"`
+	// Purge is the schedule of the purge run
+	Purge string `json:"purge,omitempty"`
+	// PurgeUnknown is the schedule of the purge-unknown run
+	PurgeUnknown string `json:"purge_unknown,omitempty"`
+}
+
+// PurgeUnknown defines which repositories purge-unknown may touch, unknown tags outside of this scope are only reported
+type PurgeUnknown struct {
+	// Repositories are prefixes of the repositories which may be purged including the registry, e.g. r.example.com/library/.
+	// A prefix covers whole path segments, r.example.com/team does not cover r.example.com/team-other. All repositories may be purged if empty.
+	Repositories []string `json:"repositories,omitempty"`
+	// Protected are prefixes of repositories which are never purged, even if they are part of Repositories
+	Protected []string `json:"protected,omitempty"`
+	// Exclude are shell patterns of repositories or tags which are never purged, e.g. r.example.com/*/cache or r.example.com/library/*:*-keep
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// ParseConfig strictly decodes a v2 config file and converts it to v1, which is used to mirror.
+// Every problem is reported with its line, images and registries remember their line for the errors of Validate.
+// The returned config contains everything which could be decoded.
+func ParseConfig(file string, raw []byte) (apiv1.Config, error) {
+	var c Config
+	errs := []error{apiv1.DecodeStrict(file, raw, &c)}
+	if c.APIVersion != APIVersion || c.Kind != Kind {
+		errs = append(errs, fmt.Errorf("apiVersion and kind must be %q and %q, got %q and %q, file:%q", APIVersion, Kind, c.APIVersion, c.Kind, file))
+	}
+	converted := c.ToV1()
+	converted.RecordOrigins(file, raw)
+	return converted, errors.Join(errs...)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	apiv2 "github.com/metal-stack/oci-mirror/api/v2"
+	"github.com/urfave/cli/v2"
+	yamlv3 "go.yaml.in/yaml/v3"
+	"sigs.k8s.io/yaml"
+)
+
+// newLogger returns the json logger of a command, in dry-run mode it logs to stderr to keep stdout clean for the plan
+func newLogger(ctx *cli.Context) *slog.Logger {
+	level := slog.LevelInfo
+	if ctx.Bool(debugFlag.Name) {
+		level = slog.LevelDebug
+	}
+	logOutput := os.Stdout
+	if ctx.Bool(dryRunFlag.Name) {
+		logOutput = os.Stderr
+	}
+	return slog.New(slog.NewJSONHandler(logOutput, &slog.HandlerOptions{Level: level}))
+}
+
+// loadConfig reads the config files, globs and directories, merges and validates them.
+// The problems of all files are reported together, the parts of a file which could be decoded are validated as well. Without resolveSecrets the secret references are kept,
+// which allows to validate the config without the secrets.
+func loadConfig(paths []string, resolveSecrets bool) (apiv1.Config, error) {
+	var config apiv1.Config
+	files, err := apiv1.ConfigFiles(paths)
+	if err != nil {
+		return config, err
+	}
+
+	var errs []error
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return config, fmt.Errorf("unable to read config file:%w", err)
+		}
+		part, err := parseConfig(file, raw)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		config.Merge(file, part)
+	}
+
+	if resolveSecrets {
+		config.ResolveSecrets()
+	} else {
+		config.KeepSecretReferences()
+	}
+	errs = append(errs, config.Validate())
+	if err := errors.Join(errs...); err != nil {
+		return config, fmt.Errorf("config invalid:%w", err)
+	}
+	return config, nil
+}
+
+// parseConfig strictly decodes a config file of any api version and converts it to v1, which is used to mirror
+func parseConfig(file string, raw []byte) (apiv1.Config, error) {
+	var header struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	// the header is decoded leniently, the strict decoding of the version reports all problems
+	if err := yaml.Unmarshal(raw, &header); err != nil {
+		return apiv1.Config{}, fmt.Errorf("unable to parse config file:%q %w", file, err)
+	}
+	switch header.APIVersion {
+	case "", apiv1.APIVersion:
+		return apiv1.ParseConfig(file, raw)
+	case apiv2.APIVersion:
+		return apiv2.ParseConfig(file, raw)
+	default:
+		return apiv1.Config{}, fmt.Errorf("apiVersion is not supported:%q, file:%q", header.APIVersion, file)
+	}
+}
+
+// convertConfig converts a single config file to the given api version, secret references are kept
+func convertConfig(paths []string, apiVersion string) ([]byte, error) {
+	files, err := apiv1.ConfigFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 1 {
+		return nil, fmt.Errorf("exactly one config file can be converted, got %d", len(files))
+	}
+	raw, err := os.ReadFile(files[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file:%w", err)
+	}
+	config, err := parseConfig(files[0], raw)
+	if err != nil {
+		return nil, fmt.Errorf("config invalid:%w", err)
+	}
+	config.KeepSecretReferences()
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("config invalid:%w", err)
+	}
+
+	switch apiVersion {
+	case apiv1.APIVersion:
+		config.APIVersion, config.Kind = apiv1.APIVersion, apiv1.Kind
+		return marshalOrdered(config)
+	case apiv2.APIVersion:
+		return marshalOrdered(apiv2.FromV1(config))
+	default:
+		return nil, fmt.Errorf("apiVersion is not supported:%q, can be %q or %q", apiVersion, apiv1.APIVersion, apiv2.APIVersion)
+	}
+}
+
+// marshalOrdered writes the config as yaml with the keys in the order of the struct fields, the header comes first
+func marshalOrdered(config any) ([]byte, error) {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	// json is yaml, the nodes keep the order of the keys
+	var node yamlv3.Node
+	if err := yamlv3.Unmarshal(raw, &node); err != nil {
+		return nil, err
+	}
+	var plain func(n *yamlv3.Node)
+	plain = func(n *yamlv3.Node) {
+		n.Style = 0
+		for _, child := range n.Content {
+			plain(child)
+		}
+	}
+	plain(&node)
+
+	var buf bytes.Buffer
+	encoder := yamlv3.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	apiv2 "github.com/metal-stack/oci-mirror/api/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+	main := write("oci-mirror.yaml", `
+registries:
+  r.example.com:
+    auth:
+      username: robot
+      password: "${OCI_MIRROR_TEST_PASSWORD}"
+images:
+  - source: alpine
+    destination: r.example.com/library/alpine
+    match:
+      all_tags: true
+`)
+	write("conf.d/busybox.yaml", `
+images:
+  - source: busybox
+    destination: r.example.com/library/busybox
+    match:
+      semver: ">= 1.36"
+`)
+
+	// secrets are kept without resolving them
+	config, err := loadConfig([]string{main, filepath.Join(dir, "conf.d")}, false)
+	require.NoError(t, err)
+	require.Len(t, config.Images, 2)
+	require.Equal(t, "${OCI_MIRROR_TEST_PASSWORD}", config.Registries["r.example.com"].Auth.Password)
+
+	_, err = loadConfig([]string{main}, true)
+	require.ErrorContains(t, err, "environment variables are not set:OCI_MIRROR_TEST_PASSWORD")
+
+	t.Setenv("OCI_MIRROR_TEST_PASSWORD", "secret")
+	config, err = loadConfig([]string{main}, true)
+	require.NoError(t, err)
+	require.Equal(t, "secret", config.Registries["r.example.com"].Auth.Password)
+
+	// the problems of all files are reported
+	typo := write("conf.d/typo.yaml", `
+images:
+  - source: debian
+    destination: r.example.com/library/debian
+    match:
+      all-tags: true
+`)
+	duplicate := write("duplicate.yaml", `
+images:
+  - source: alpine
+    destination: r.example.com/mirror/alpine
+    match:
+      allTags: true
+`)
+	_, err = loadConfig([]string{main, filepath.Join(dir, "conf.d"), duplicate}, true)
+	require.ErrorContains(t, err, `unknown key "all-tags" in images[0].match, did you mean "all_tags"?, file:"`+typo+`:6"`)
+	require.ErrorContains(t, err, `unknown key "allTags" in images[0].match, did you mean "all_tags"?, file:"`+duplicate+`:6"`)
+
+	require.NoError(t, os.Remove(typo))
+	require.NoError(t, os.WriteFile(duplicate, []byte(`
+images:
+  - source: alpine
+    destination: r.example.com/mirror/alpine
+    match:
+      all_tags: true
+`), 0600))
+	_, err = loadConfig([]string{main, duplicate}, true)
+	require.ErrorContains(t, err, `image source is duplicate:"alpine" first defined in file:"`+main+`:8", file:"`+duplicate+`:3"`)
+
+	// decoding and validation problems are reported in one pass, at the line of their key
+	invalid := write("invalid.yaml", `
+images:
+  - source: debian
+    destination: r.example.com/library/debian
+    match:
+      all-tags: true
+  - source: ubuntu
+    destination: r.example.com/library/ubuntu
+    match:
+      semver: "bad"
+`)
+	_, err = loadConfig([]string{invalid}, true)
+	require.ErrorContains(t, err, `unknown key "all-tags" in images[0].match, did you mean "all_tags"?, file:"`+invalid+`:6"`)
+	require.ErrorContains(t, err, `image.match.semver is invalid, image source:"ubuntu", semver:"bad"`)
+	require.ErrorContains(t, err, `file:"`+invalid+`:10"`)
+}
+
+func TestValidateCommand(t *testing.T) {
+	var out bytes.Buffer
+	app := &cli.App{Writer: &out, Commands: []*cli.Command{validateCmd}}
+	require.NoError(t, app.Run([]string{"oci-mirror", "validate", "--mirror-config", "../oci-mirror.yaml"}))
+	require.Contains(t, out.String(), "configuration is valid")
+
+	path := filepath.Join(t.TempDir(), "invalid.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("images:\n  - source: alpine\n    destination: alpine\n"), 0600))
+	require.Error(t, app.Run([]string{"oci-mirror", "validate", "--mirror-config", path}))
+}
+
+func TestConvertConfig(t *testing.T) {
+	dir := t.TempDir()
+	v1 := filepath.Join(dir, "v1.yaml")
+	require.NoError(t, os.WriteFile(v1, []byte(`
+registries:
+  r.example.com:
+    auth:
+      username: robot
+      password: "${OCI_MIRROR_TEST_PASSWORD}"
+images:
+  - source: alpine
+    destination: r.example.com/library/alpine
+    match:
+      all_tags: true
+`), 0600))
+
+	converted, err := convertConfig([]string{v1}, apiv2.APIVersion)
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: oci-mirror.metal-stack.io/v2
+kind: MirrorConfig
+images:
+  - source: alpine
+    destinations:
+      - destination: r.example.com/library/alpine
+    match:
+      all_tags: true
+registries:
+  r.example.com:
+    auth:
+      username: robot
+      password: ${OCI_MIRROR_TEST_PASSWORD}
+`, string(converted))
+
+	// the converted config is loaded like a v1 config
+	v2 := filepath.Join(dir, "v2.yaml")
+	require.NoError(t, os.WriteFile(v2, converted, 0600))
+	fromV1, err := loadConfig([]string{v1}, false)
+	require.NoError(t, err)
+	fromV2, err := loadConfig([]string{v2}, false)
+	require.NoError(t, err)
+	require.Equal(t, fromV1.Images[0].Source, fromV2.Images[0].Source)
+	require.Equal(t, fromV1.Images[0].Destination, fromV2.Images[0].Destination)
+	require.Equal(t, fromV1.Images[0].Match, fromV2.Images[0].Match)
+	require.Equal(t, fromV1.Registries, fromV2.Registries)
+
+	back, err := convertConfig([]string{v2}, apiv1.APIVersion)
+	require.NoError(t, err)
+	require.Contains(t, string(back), "apiVersion: oci-mirror.metal-stack.io/v1\nkind: MirrorConfig\n")
+	require.Contains(t, string(back), "destination: r.example.com/library/alpine")
+
+	_, err = convertConfig([]string{v1}, "oci-mirror.metal-stack.io/v3")
+	require.ErrorContains(t, err, "apiVersion is not supported")
+	_, err = convertConfig([]string{v1, v2}, apiv2.APIVersion)
+	require.ErrorContains(t, err, "exactly one config file")
+
+	unknown := filepath.Join(dir, "unknown.yaml")
+	require.NoError(t, os.WriteFile(unknown, []byte("apiVersion: oci-mirror.metal-stack.io/v3\n"), 0600))
+	_, err = loadConfig([]string{unknown}, false)
+	require.ErrorContains(t, err, `apiVersion is not supported:"oci-mirror.metal-stack.io/v3"`)
+}
@@ -1,25 +1,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	apiv2 "github.com/metal-stack/oci-mirror/api/v2"
 	"github.com/metal-stack/oci-mirror/pkg/container"
 	"github.com/metal-stack/v"
 
 	"github.com/urfave/cli/v2"
-	"sigs.k8s.io/yaml"
 )
 
 var (
-	configMapFlag = &cli.StringFlag{
+	configMapFlag = &cli.StringSliceFlag{
 		Name:  "mirror-config",
-		Usage: "path to mirror-config-map",
-		Value: "oci-mirror.yaml",
+		Usage: "path to mirror-config-map, can be given several times, globs and directories of yaml files are merged",
+		Value: cli.NewStringSlice("oci-mirror.yaml"),
 	}
 	debugFlag = &cli.BoolFlag{
 		Name:  "debug",
@@ -41,6 +42,44 @@ var (
 		Usage: "maximum delay between retry attempts",
 		Value: 5 * time.Minute,
 	}
+	dryRunFlag = &cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "print the planned actions without performing any writes",
+		Value: false,
+	}
+	outputFlag = &cli.StringFlag{
+		Name:  "output",
+		Usage: "output format of the dry-run plan, can be table or json",
+		Value: outputTable,
+	}
+	listenAddressFlag = &cli.StringFlag{
+		Name:  "listen-address",
+		Usage: "address of the health and readiness endpoints in daemon mode",
+		Value: ":8080",
+	}
+	pushgatewayFlag = &cli.StringFlag{
+		Name:  "metrics.pushgateway-url",
+		Usage: "url of a pushgateway where the metrics of the run are pushed to, disabled if empty",
+	}
+	archiveFlag = &cli.StringFlag{
+		Name:     "archive",
+		Usage:    "OCI image layout directory or tarball to import, e.g. /mnt/bundle.tar or oci-layout:///mnt/layout",
+		Required: true,
+	}
+	resolveSecretsFlag = &cli.BoolFlag{
+		Name:  "resolve-secrets",
+		Usage: "also resolve the ${ENV_VAR} and file:// references, requires the secrets to be available",
+	}
+	toAPIVersionFlag = &cli.StringFlag{
+		Name:  "to",
+		Usage: "apiVersion of the converted configuration",
+		Value: apiv2.APIVersion,
+	}
+	concurrencyFlag = &cli.IntFlag{
+		Name:  "concurrency",
+		Usage: "number of images and tags which are mirrored concurrently",
+		Value: 1,
+	}
 
 	mirrorCmd = &cli.Command{
 		Name:  "mirror",
@@ -51,38 +90,84 @@ var (
 			retryMaxAttemptsFlag,
 			retryInitialDelayFlag,
 			retryMaxDelayFlag,
+			concurrencyFlag,
+			dryRunFlag,
+			outputFlag,
+			pushgatewayFlag,
 		},
 		Action: func(ctx *cli.Context) error {
-			level := slog.LevelInfo
-			if ctx.Bool(debugFlag.Name) {
-				level = slog.LevelDebug
-			}
-			jsonHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
-			log := slog.New(jsonHandler)
+			log := newLogger(ctx)
 
 			log.Info("start mirror", "version", v.V.String())
-			raw, err := os.ReadFile(ctx.String(configMapFlag.Name))
+			config, err := loadConfig(ctx.StringSlice(configMapFlag.Name), true)
 			if err != nil {
-				return fmt.Errorf("unable to read config file:%w", err)
+				return err
+			}
+
+			s := newServer(log, config, &container.RetryPolicy{
+				MaxAttempts:  ctx.Int(retryMaxAttemptsFlag.Name),
+				InitialDelay: ctx.Duration(retryInitialDelayFlag.Name),
+				MaxDelay:     ctx.Duration(retryMaxDelayFlag.Name),
+			}, ctx.Int(concurrencyFlag.Name))
+			if ctx.Bool(dryRunFlag.Name) {
+				if err := s.enableDryRun(ctx.String(outputFlag.Name)); err != nil {
+					return err
+				}
+			}
+			err = s.mirror(context.Background())
+			if url := ctx.String(pushgatewayFlag.Name); url != "" {
+				if err := s.pushMetrics(url, "mirror"); err != nil {
+					log.Error("error during metrics push", "error", err)
+				}
 			}
-			var config apiv1.Config
-			err = yaml.Unmarshal(raw, &config)
 			if err != nil {
-				return fmt.Errorf("unable to parse config file:%w", err)
+				log.Error("error during mirror", "error", err)
+				os.Exit(1)
 			}
+			return nil
+		},
+	}
+	importCmd = &cli.Command{
+		Name:  "import",
+		Usage: "push the images of an archive written by mirror to the destinations in the configuration",
+		Flags: []cli.Flag{
+			debugFlag,
+			configMapFlag,
+			archiveFlag,
+			retryMaxAttemptsFlag,
+			retryInitialDelayFlag,
+			retryMaxDelayFlag,
+			dryRunFlag,
+			outputFlag,
+			pushgatewayFlag,
+		},
+		Action: func(ctx *cli.Context) error {
+			log := newLogger(ctx)
 
-			err = config.Validate()
+			log.Info("start import", "version", v.V.String())
+			config, err := loadConfig(ctx.StringSlice(configMapFlag.Name), true)
 			if err != nil {
-				return fmt.Errorf("config invalid:%w", err)
+				return err
 			}
 
 			s := newServer(log, config, &container.RetryPolicy{
 				MaxAttempts:  ctx.Int(retryMaxAttemptsFlag.Name),
 				InitialDelay: ctx.Duration(retryInitialDelayFlag.Name),
 				MaxDelay:     ctx.Duration(retryMaxDelayFlag.Name),
-			})
-			if err := s.mirror(); err != nil {
-				log.Error("error during mirror", "error", err)
+			}, 1)
+			if ctx.Bool(dryRunFlag.Name) {
+				if err := s.enableDryRun(ctx.String(outputFlag.Name)); err != nil {
+					return err
+				}
+			}
+			err = s.importArchive(context.Background(), ctx.String(archiveFlag.Name))
+			if url := ctx.String(pushgatewayFlag.Name); url != "" {
+				if err := s.pushMetrics(url, "import"); err != nil {
+					log.Error("error during metrics push", "error", err)
+				}
+			}
+			if err != nil {
+				log.Error("error during import", "error", err)
 				os.Exit(1)
 			}
 			return nil
@@ -94,72 +179,134 @@ var (
 		Flags: []cli.Flag{
 			debugFlag,
 			configMapFlag,
+			dryRunFlag,
+			outputFlag,
+			pushgatewayFlag,
 		},
 		Action: func(ctx *cli.Context) error {
-			level := slog.LevelInfo
-			if ctx.Bool(debugFlag.Name) {
-				level = slog.LevelDebug
-			}
-			jsonHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
-			log := slog.New(jsonHandler)
+			log := newLogger(ctx)
 
 			log.Info("start purge", "version", v.V.String())
-			raw, err := os.ReadFile(ctx.String(configMapFlag.Name))
-			if err != nil {
-				return fmt.Errorf("unable to read config file:%w", err)
-			}
-			var config apiv1.Config
-			err = yaml.Unmarshal(raw, &config)
+			config, err := loadConfig(ctx.StringSlice(configMapFlag.Name), true)
 			if err != nil {
-				return fmt.Errorf("unable to parse config file:%w", err)
+				return err
 			}
 
-			err = config.Validate()
-			if err != nil {
-				return fmt.Errorf("config invalid:%w", err)
+			s := newServer(log, config, nil, 1)
+			if ctx.Bool(dryRunFlag.Name) {
+				if err := s.enableDryRun(ctx.String(outputFlag.Name)); err != nil {
+					return err
+				}
 			}
-
-			s := newServer(log, config, nil)
-			if err := s.purge(); err != nil {
+			err = s.purge(context.Background())
+			if url := ctx.String(pushgatewayFlag.Name); url != "" {
+				if err := s.pushMetrics(url, "purge"); err != nil {
+					log.Error("error during metrics push", "error", err)
+				}
+			}
+			if err != nil {
 				log.Error("error during purge", "error", err)
 				os.Exit(1)
 			}
 			return nil
 		},
 	}
-	purgeUnknownCmd = &cli.Command{
-		Name:  "purge-unknown",
-		Usage: "purge unknown images according to the configuration",
+	serveCmd = &cli.Command{
+		Name:  "serve",
+		Usage: "run mirror, purge and purge-unknown as a daemon according to the schedules in the configuration",
 		Flags: []cli.Flag{
 			debugFlag,
 			configMapFlag,
+			retryMaxAttemptsFlag,
+			retryInitialDelayFlag,
+			retryMaxDelayFlag,
+			concurrencyFlag,
+			listenAddressFlag,
 		},
 		Action: func(ctx *cli.Context) error {
-			level := slog.LevelInfo
-			if ctx.Bool(debugFlag.Name) {
-				level = slog.LevelDebug
+			log := newLogger(ctx)
+
+			log.Info("start serve", "version", v.V.String())
+			config, err := loadConfig(ctx.StringSlice(configMapFlag.Name), true)
+			if err != nil {
+				return err
 			}
-			jsonHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
-			log := slog.New(jsonHandler)
 
-			log.Info("start purge unknown", "version", v.V.String())
-			raw, err := os.ReadFile(ctx.String(configMapFlag.Name))
+			s := newServer(log, config, &container.RetryPolicy{
+				MaxAttempts:  ctx.Int(retryMaxAttemptsFlag.Name),
+				InitialDelay: ctx.Duration(retryInitialDelayFlag.Name),
+				MaxDelay:     ctx.Duration(retryMaxDelayFlag.Name),
+			}, ctx.Int(concurrencyFlag.Name))
+
+			signalCtx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return s.serve(signalCtx, ctx.String(listenAddressFlag.Name))
+		},
+	}
+	validateCmd = &cli.Command{
+		Name:  "validate",
+		Usage: "check the configuration without contacting any registry, e.g. in CI",
+		Flags: []cli.Flag{
+			configMapFlag,
+			resolveSecretsFlag,
+		},
+		Action: func(ctx *cli.Context) error {
+			config, err := loadConfig(ctx.StringSlice(configMapFlag.Name), ctx.Bool(resolveSecretsFlag.Name))
 			if err != nil {
-				return fmt.Errorf("unable to read config file:%w", err)
+				return err
 			}
-			var config apiv1.Config
-			err = yaml.Unmarshal(raw, &config)
+			_, err = fmt.Fprintf(ctx.App.Writer, "configuration is valid, %d images\n", len(config.Images))
+			return err
+		},
+	}
+	convertCmd = &cli.Command{
+		Name:  "convert",
+		Usage: "convert a configuration file to another api version and print it, comments are not preserved",
+		Flags: []cli.Flag{
+			configMapFlag,
+			toAPIVersionFlag,
+		},
+		Action: func(ctx *cli.Context) error {
+			converted, err := convertConfig(ctx.StringSlice(configMapFlag.Name), ctx.String(toAPIVersionFlag.Name))
 			if err != nil {
-				return fmt.Errorf("unable to parse config file:%w", err)
+				return err
 			}
+			_, err = ctx.App.Writer.Write(converted)
+			return err
+		},
+	}
+	purgeUnknownCmd = &cli.Command{
+		Name:  "purge-unknown",
+		Usage: "purge unknown images according to the configuration",
+		Flags: []cli.Flag{
+			debugFlag,
+			configMapFlag,
+			dryRunFlag,
+			outputFlag,
+			pushgatewayFlag,
+		},
+		Action: func(ctx *cli.Context) error {
+			log := newLogger(ctx)
 
-			err = config.Validate()
+			log.Info("start purge unknown", "version", v.V.String())
+			config, err := loadConfig(ctx.StringSlice(configMapFlag.Name), true)
 			if err != nil {
-				return fmt.Errorf("config invalid:%w", err)
+				return err
 			}
 
-			s := newServer(log, config, nil)
-			if err := s.purgeUnknown(); err != nil {
+			s := newServer(log, config, nil, 1)
+			if ctx.Bool(dryRunFlag.Name) {
+				if err := s.enableDryRun(ctx.String(outputFlag.Name)); err != nil {
+					return err
+				}
+			}
+			err = s.purgeUnknown(context.Background())
+			if url := ctx.String(pushgatewayFlag.Name); url != "" {
+				if err := s.pushMetrics(url, "purge-unknown"); err != nil {
+					log.Error("error during metrics push", "error", err)
+				}
+			}
+			if err != nil {
 				log.Error("error during purge", "error", err)
 				os.Exit(1)
 			}
@@ -174,8 +321,12 @@ func main() {
 		Usage: "oci mirror server",
 		Commands: []*cli.Command{
 			mirrorCmd,
+			importCmd,
 			purgeCmd,
 			purgeUnknownCmd,
+			serveCmd,
+			validateCmd,
+			convertCmd,
 		},
 	}
 
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/metal-stack/oci-mirror/pkg/container"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// printPlan writes the actions of a dry-run in the given output format
+func printPlan(w io.Writer, actions []container.Action, output string) error {
+	switch output {
+	case outputJSON:
+		if actions == nil {
+			actions = []container.Action{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(actions)
+	case outputTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "OPERATION\tSOURCE\tDESTINATION\tDIGEST")
+		for _, a := range actions {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.Operation, a.Source, a.Destination, a.Digest)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unsupported output format:%q", output)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/metal-stack/oci-mirror/pkg/container"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintPlan(t *testing.T) {
+	actions := []container.Action{
+		{Operation: container.OperationCopy, Source: "alpine:3.18", Destination: "localhost:5000/library/alpine:3.18"},
+		{Operation: container.OperationSkip, Source: "alpine:3.17", Destination: "localhost:5000/library/alpine:3.17", Digest: "sha256:abc"},
+		{Operation: container.OperationDelete, Destination: "localhost:5000/library/alpine:3.10", Digest: "sha256:def"},
+	}
+
+	tests := []struct {
+		name    string
+		actions []container.Action
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "table",
+			actions: actions,
+			output:  outputTable,
+			want: `OPERATION  SOURCE       DESTINATION                         DIGEST
+copy       alpine:3.18  localhost:5000/library/alpine:3.18  
+skip       alpine:3.17  localhost:5000/library/alpine:3.17  sha256:abc
+delete                  localhost:5000/library/alpine:3.10  sha256:def
+`,
+		},
+		{
+			name:    "json",
+			actions: actions[2:],
+			output:  outputJSON,
+			want: `[
+  {
+    "operation": "delete",
+    "destination": "localhost:5000/library/alpine:3.10",
+    "digest": "sha256:def"
+  }
+]
+`,
+		},
+		{
+			name:   "empty json",
+			output: outputJSON,
+			want:   "[]\n",
+		},
+		{
+			name:    "unsupported output",
+			output:  "yaml",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := printPlan(&buf, tt.actions, tt.output)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, buf.String())
+		})
+	}
+}
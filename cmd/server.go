@@ -2,60 +2,246 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
 	"github.com/metal-stack/oci-mirror/pkg/container"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/robfig/cron/v3"
 )
 
 type server struct {
 	log         *slog.Logger
 	config      apiv1.Config
 	retryPolicy *container.RetryPolicy
+	concurrency int
+	// dryRun only prints the planned actions in the output format
+	dryRun bool
+	output string
+	// out receives the plan of a dry-run
+	out io.Writer
+
+	// runs serializes scheduled runs in daemon mode
+	runs sync.Mutex
+	// ready is set once the scheduler is running in daemon mode
+	ready atomic.Bool
+
+	registry *prometheus.Registry
+	metrics  *container.Metrics
 }
 
-func newServer(log *slog.Logger, config apiv1.Config, retryPolicy *container.RetryPolicy) *server {
+func newServer(log *slog.Logger, config apiv1.Config, retryPolicy *container.RetryPolicy, concurrency int) *server {
+	registry := prometheus.NewRegistry()
 	return &server{
 		log:         log,
 		config:      config,
 		retryPolicy: retryPolicy,
+		concurrency: concurrency,
+		out:         os.Stdout,
+		registry:    registry,
+		metrics:     container.NewMetrics(registry),
+	}
+}
+
+// enableDryRun configures the server to print the planned actions in the given output format instead of performing them
+func (s *server) enableDryRun(output string) error {
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("unsupported output format:%q", output)
 	}
+	s.dryRun = true
+	s.output = output
+	return nil
 }
 
-func (s *server) mirror() error {
+// printDryRun prints the plan of a dry-run, the actions planned so far are printed even if the run failed
+func (s *server) printDryRun(actions []container.Action, err error) error {
+	if !s.dryRun {
+		return err
+	}
+	return errors.Join(err, printPlan(s.out, actions, s.output))
+}
+
+func (s *server) mirror(ctx context.Context) error {
 	start := time.Now()
 	m := container.New(s.log.WithGroup("mirror"), s.config, s.retryPolicy)
-	err := m.Mirror(context.Background())
+	m.SetConcurrency(s.concurrency)
+	m.SetDryRun(s.dryRun)
+	m.SetMetrics(s.metrics)
+	err := m.Mirror(ctx)
 	if err != nil {
 		s.log.Error(fmt.Sprintf("error mirroring images, duration %s", time.Since(start)), "error", err)
-		return err
+	} else {
+		s.log.Info(fmt.Sprintf("finished mirroring after %s", time.Since(start)))
 	}
-	s.log.Info(fmt.Sprintf("finished mirroring after %s", time.Since(start)))
-	return nil
+	return s.printDryRun(m.Plan(), err)
+}
+
+// importArchive pushes the images of the archive at location to their destinations
+func (s *server) importArchive(ctx context.Context, location string) error {
+	start := time.Now()
+	m := container.New(s.log.WithGroup("import"), s.config, s.retryPolicy)
+	m.SetDryRun(s.dryRun)
+	m.SetMetrics(s.metrics)
+	err := m.Import(ctx, location)
+	if err != nil {
+		s.log.Error(fmt.Sprintf("error importing images, duration %s", time.Since(start)), "error", err)
+	} else {
+		s.log.Info(fmt.Sprintf("finished importing after %s", time.Since(start)))
+	}
+	return s.printDryRun(m.Plan(), err)
 }
 
-func (s *server) purge() error {
+func (s *server) purge(ctx context.Context) error {
 	start := time.Now()
 	m := container.New(s.log.WithGroup("purge"), s.config, s.retryPolicy)
-	err := m.Purge(context.Background())
+	m.SetDryRun(s.dryRun)
+	m.SetMetrics(s.metrics)
+	err := m.Purge(ctx)
 	if err != nil {
 		s.log.Error(fmt.Sprintf("error purging images, duration %s", time.Since(start)), "error", err)
-		return err
+	} else {
+		s.log.Info(fmt.Sprintf("finished purging after %s", time.Since(start)))
 	}
-	s.log.Info(fmt.Sprintf("finished purging after %s", time.Since(start)))
-	return nil
+	return s.printDryRun(m.Plan(), err)
 }
 
-func (s *server) purgeUnknown() error {
+func (s *server) purgeUnknown(ctx context.Context) error {
 	start := time.Now()
 	m := container.New(s.log.WithGroup("purgeunknown"), s.config, s.retryPolicy)
-	err := m.PurgeUnknown(context.Background())
+	m.SetDryRun(s.dryRun)
+	m.SetMetrics(s.metrics)
+	err := m.PurgeUnknown(ctx)
 	if err != nil {
 		s.log.Error(fmt.Sprintf("error purging unknown images, duration %s", time.Since(start)), "error", err)
-		return err
+	} else {
+		s.log.Info(fmt.Sprintf("finished purging unknown after %s", time.Since(start)))
+	}
+	return s.printDryRun(m.Plan(), err)
+}
+
+// serve runs mirror, purge and purge-unknown according to the configured schedules until the context is canceled.
+// Health and readiness endpoints are served on the listen address.
+func (s *server) serve(ctx context.Context, listenAddress string) error {
+	var schedules apiv1.Schedules
+	if s.config.Schedules != nil {
+		schedules = *s.config.Schedules
+	}
+
+	s.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	scheduler := cron.New()
+	for _, job := range []struct {
+		name     string
+		schedule string
+		run      func(context.Context) error
+	}{
+		{name: "mirror", schedule: schedules.Mirror, run: s.mirror},
+		{name: "purge", schedule: schedules.Purge, run: s.purge},
+		{name: "purge-unknown", schedule: schedules.PurgeUnknown, run: s.purgeUnknown},
+	} {
+		if job.schedule == "" {
+			s.log.Info("no schedule configured, run is disabled", "run", job.name)
+			continue
+		}
+		_, err := scheduler.AddFunc(job.schedule, s.scheduledRun(ctx, job.name, job.run))
+		if err != nil {
+			return fmt.Errorf("unable to schedule %s:%w", job.name, err)
+		}
+		s.log.Info("scheduled run", "run", job.name, "schedule", job.schedule)
+	}
+
+	srv := &http.Server{
+		Addr:              listenAddress,
+		Handler:           s.router(),
+		ReadHeaderTimeout: time.Minute,
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.ready.Store(false)
+		s.log.Info("shutting down, waiting for running jobs")
+		<-scheduler.Stop().Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			s.log.Error("unable to shutdown http server", "error", err)
+		}
+	}()
+
+	scheduler.Start()
+	s.ready.Store(true)
+
+	s.log.Info("serving health and metrics endpoints", "address", listenAddress)
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// scheduledRun wraps a run for the scheduler, a run is skipped if the previous run of the same kind is still in progress.
+// Runs of different kinds wait for each other, images are never purged while they are mirrored.
+func (s *server) scheduledRun(ctx context.Context, name string, run func(context.Context) error) func() {
+	var running sync.Mutex
+	return func() {
+		if !running.TryLock() {
+			s.log.Warn("previous run still in progress, skip scheduled run", "run", name)
+			return
+		}
+		defer running.Unlock()
+
+		s.runs.Lock()
+		defer s.runs.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+		s.log.Info("start scheduled run", "run", name)
+		if err := run(ctx); err != nil {
+			s.log.Error("scheduled run failed", "run", name, "error", err)
+		}
+	}
+}
+
+func (s *server) router() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if !s.ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.Handle("GET /metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// pushMetrics pushes the collected metrics of a single run to a pushgateway
+func (s *server) pushMetrics(url, command string) error {
+	err := push.New(url, "oci-mirror").
+		Gatherer(s.registry).
+		Grouping("command", command).
+		Push()
+	if err != nil {
+		return fmt.Errorf("unable to push metrics to %q:%w", url, err)
 	}
-	s.log.Info(fmt.Sprintf("finished purging unknown after %s", time.Since(start)))
 	return nil
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	s := newServer(slog.New(slog.DiscardHandler), apiv1.Config{}, nil, 1)
+	srv := httptest.NewServer(s.router())
+	defer srv.Close()
+
+	get := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, get("/healthz"))
+	require.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+
+	s.ready.Store(true)
+	require.Equal(t, http.StatusOK, get("/readyz"))
+	require.Equal(t, http.StatusOK, get("/metrics"))
+}
+
+func TestPushMetrics(t *testing.T) {
+	var (
+		method string
+		path   string
+		body   string
+	)
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.Path
+		raw, _ := io.ReadAll(r.Body)
+		body = string(raw)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer pushgateway.Close()
+
+	s := newServer(slog.New(slog.DiscardHandler), apiv1.Config{}, nil, 1)
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "oci_mirror_test_total"})
+	s.registry.MustRegister(counter)
+	counter.Inc()
+
+	err := s.pushMetrics(pushgateway.URL, "purge-unknown")
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPut, method)
+	require.Equal(t, "/metrics/job/oci-mirror/command/purge-unknown", path)
+	require.Contains(t, body, "oci_mirror_test_total")
+
+	pushgateway.Close()
+	err = s.pushMetrics(pushgateway.URL, "mirror")
+	require.Error(t, err)
+}
+
+func TestScheduledRunsDoNotOverlap(t *testing.T) {
+	s := newServer(slog.New(slog.DiscardHandler), apiv1.Config{}, nil, 1)
+
+	var (
+		running    atomic.Int32
+		overlapped atomic.Bool
+		mirrorRuns atomic.Int32
+		purgeRuns  atomic.Int32
+		release    = make(chan struct{})
+	)
+	run := func(counter *atomic.Int32) func(context.Context) error {
+		return func(context.Context) error {
+			if running.Add(1) > 1 {
+				overlapped.Store(true)
+			}
+			defer running.Add(-1)
+			counter.Add(1)
+			<-release
+			return errors.New("failed runs must not stop the scheduler")
+		}
+	}
+	mirror := s.scheduledRun(context.Background(), "mirror", run(&mirrorRuns))
+	purge := s.scheduledRun(context.Background(), "purge", run(&purgeRuns))
+
+	var wg sync.WaitGroup
+	wg.Go(mirror)
+	require.Eventually(t, func() bool { return mirrorRuns.Load() == 1 }, time.Second, time.Millisecond)
+
+	// the same run is skipped while it is still in progress
+	mirror()
+	// a different run waits until the running one finished
+	wg.Go(purge)
+
+	close(release)
+	wg.Wait()
+
+	require.False(t, overlapped.Load())
+	require.Equal(t, int32(1), mirrorRuns.Load())
+	require.Equal(t, int32(1), purgeRuns.Load())
+
+	mirror()
+	require.Equal(t, int32(2), mirrorRuns.Load())
+}
+
+func TestDryRunPrintsPlanOnError(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, crane.Push(img, host+"/library/alpine:3.20"))
+
+	s := newServer(slog.New(slog.DiscardHandler), apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{Source: host + "/library/alpine", Destination: host + "/mirror/alpine", Match: apiv1.Match{AllTags: true}},
+			// nothing listens on this port
+			{Source: "127.0.0.1:1/library/busybox", Destination: host + "/mirror/busybox", Match: apiv1.Match{AllTags: true}},
+		},
+	}, nil, 1)
+	require.NoError(t, s.enableDryRun(outputTable))
+	var out bytes.Buffer
+	s.out = &out
+
+	err = s.mirror(context.Background())
+	require.ErrorContains(t, err, "127.0.0.1:1")
+	require.Contains(t, out.String(), host+"/library/alpine:3.20")
+	require.Contains(t, out.String(), host+"/mirror/alpine:3.20")
+	require.NotContains(t, out.String(), "busybox")
+}
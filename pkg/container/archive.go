@@ -0,0 +1,532 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+)
+
+const (
+	// annotationRefName is the annotation which names an image in the index of an OCI image layout
+	annotationRefName = "org.opencontainers.image.ref.name"
+	// annotationSource records the untouched source reference of an archived image, e.g. alpine:3.19
+	annotationSource = "io.metal-stack.oci-mirror.source"
+)
+
+// archive is a destination on disk, images are written to an OCI image layout,
+// for tar destinations the layout is unpacked to a temporary directory and packed again when the archive is closed.
+type archive struct {
+	format apiv1.ArchiveFormat
+	// path is the layout directory or the tarball
+	path string
+	// layout the images are written to, empty if it does not exist and must not be created in dry-run mode
+	layout layout.Path
+	// mu guards the index of the layout
+	mu sync.Mutex
+	// changed is true if an image was written since the archive was opened
+	changed bool
+}
+
+// archiveSet are the archives opened during a mirror run by their destination
+type archiveSet struct {
+	mu     sync.Mutex
+	opened map[string]*archive
+}
+
+// archive returns the archive of the destination, it is opened once and kept open until the mirror run is finished
+func (m *mirror) archive(destination string) (*archive, error) {
+	m.archives.mu.Lock()
+	defer m.archives.mu.Unlock()
+	if a, ok := m.archives.opened[destination]; ok {
+		return a, nil
+	}
+	format, path, _ := apiv1.ParseArchive(destination)
+	a, err := openArchive(format, path, m.plan == nil)
+	if err != nil {
+		m.log.Error("unable to open archive", "destination", destination, "error", err)
+		return nil, fmt.Errorf("unable to open archive %q %w", destination, err)
+	}
+	if m.archives.opened == nil {
+		m.archives.opened = make(map[string]*archive)
+	}
+	m.archives.opened[destination] = a
+	return a, nil
+}
+
+// closeArchives closes all archives opened during the mirror run
+func (m *mirror) closeArchives() error {
+	m.archives.mu.Lock()
+	defer m.archives.mu.Unlock()
+	var errs []error
+	for destination, a := range m.archives.opened {
+		m.log.Debug("close archive", "destination", destination, "changed", a.changed)
+		if err := a.close(); err != nil {
+			m.log.Error("unable to close archive", "destination", destination, "error", err)
+			errs = append(errs, fmt.Errorf("unable to close archive %q %w", destination, err))
+		}
+	}
+	m.archives.opened = nil
+	return errors.Join(errs...)
+}
+
+// openArchive opens the layout or unpacks the tarball at path, missing archives are only created if create is set
+func openArchive(format apiv1.ArchiveFormat, path string, create bool) (*archive, error) {
+	a := &archive{format: format, path: path}
+	switch format {
+	case apiv1.ArchiveOCILayout:
+		if _, err := os.Stat(filepath.Join(path, "index.json")); err == nil {
+			a.layout = layout.Path(path)
+			return a, nil
+		}
+		if !create {
+			return a, nil
+		}
+		l, err := layout.Write(path, empty.Index)
+		if err != nil {
+			return nil, err
+		}
+		a.layout = l
+		return a, nil
+	case apiv1.ArchiveTar:
+		dir, err := os.MkdirTemp("", "oci-mirror-")
+		if err != nil {
+			return nil, err
+		}
+		a.layout = layout.Path(dir)
+		if _, err := os.Stat(path); err == nil {
+			err = unpackTar(path, dir)
+		} else {
+			_, err = layout.Write(dir, empty.Index)
+		}
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return nil, err
+		}
+		return a, nil
+	default:
+		return nil, fmt.Errorf("unsupported archive format %q", format)
+	}
+}
+
+// close packs the layout into the tarball if it was changed and removes the temporary layout
+func (a *archive) close() error {
+	if a.format != apiv1.ArchiveTar {
+		return nil
+	}
+	defer func() {
+		_ = os.RemoveAll(string(a.layout))
+	}()
+	if !a.changed {
+		return nil
+	}
+	return packTar(string(a.layout), a.path)
+}
+
+// archiveRef returns the name of the destination tag in the archive,
+// it is the repository of the source with the rewritten destination tag, e.g. index.docker.io/library/alpine:3.19
+func archiveRef(image apiv1.ImageMirror, dst string) (string, error) {
+	src, err := name.ParseReference(image.Source)
+	if err != nil {
+		return "", err
+	}
+	return src.Context().Name() + ":" + strings.TrimPrefix(dst, image.Destination+":"), nil
+}
+
+// digest returns the digest of the named image in the archive
+func (a *archive) digest(ref string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.layout != "" {
+		idx, err := a.layout.ImageIndex()
+		if err != nil {
+			return "", err
+		}
+		manifest, err := idx.IndexManifest()
+		if err != nil {
+			return "", err
+		}
+		for _, desc := range manifest.Manifests {
+			if desc.Annotations[annotationRefName] == ref {
+				return desc.Digest.String(), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("image %q not found in archive %q", ref, a.path)
+}
+
+// images returns the descriptors of all named images in the archive by the repository and tag of their source,
+// images without recorded source are returned by their name
+func (a *archive) images() (map[string]map[string]v1.Descriptor, error) {
+	if a.layout == "" {
+		return nil, fmt.Errorf("archive %q does not exist", a.path)
+	}
+	idx, err := a.layout.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	images := make(map[string]map[string]v1.Descriptor)
+	for _, desc := range manifest.Manifests {
+		ref, ok := desc.Annotations[annotationSource]
+		if !ok {
+			ref, ok = desc.Annotations[annotationRefName]
+		}
+		if !ok {
+			continue
+		}
+		tag, err := name.NewTag(ref)
+		if err != nil {
+			return nil, fmt.Errorf("archive %q contains the invalid image name %q %w", a.path, ref, err)
+		}
+		repository := tag.Context().Name()
+		if images[repository] == nil {
+			images[repository] = make(map[string]v1.Descriptor)
+		}
+		images[repository][tag.TagStr()] = desc
+	}
+	return images, nil
+}
+
+// read returns the image or image index of the descriptor in the archive
+func (a *archive) read(desc v1.Descriptor) (remote.Taggable, error) {
+	idx, err := a.layout.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case desc.MediaType.IsIndex():
+		return idx.ImageIndex(desc.Digest)
+	case desc.MediaType.IsImage():
+		return idx.Image(desc.Digest)
+	default:
+		return nil, fmt.Errorf("unable to read manifest %q with media type %q from archive", desc.Digest, desc.MediaType)
+	}
+}
+
+// write writes the image or image index to the archive and names it with ref, replacing a previous image of this name.
+// The source reference is recorded as well, blobs which are already in the archive are not read from the source again.
+func (a *archive) write(ref, source string, t remote.Taggable) error {
+	var (
+		desc *v1.Descriptor
+		err  error
+	)
+	switch t := t.(type) {
+	case *remote.Descriptor:
+		switch {
+		case t.MediaType.IsIndex():
+			idx, err2 := t.ImageIndex()
+			if err2 != nil {
+				return err2
+			}
+			desc, err = a.writeIndex(idx)
+		case t.MediaType.IsImage():
+			img, err2 := t.Image()
+			if err2 != nil {
+				return err2
+			}
+			desc, err = a.writeImage(img)
+		default:
+			return fmt.Errorf("unable to write manifest with media type %q to archive", t.MediaType)
+		}
+	case v1.ImageIndex:
+		desc, err = a.writeIndex(t)
+	case v1.Image:
+		desc, err = a.writeImage(t)
+	default:
+		return fmt.Errorf("unable to write %T to archive", t)
+	}
+	if err != nil {
+		return err
+	}
+	desc.Annotations = map[string]string{annotationRefName: ref, annotationSource: source}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.changed = true
+	err = a.layout.RemoveDescriptors(match.Annotation(annotationRefName, ref))
+	if err != nil {
+		return err
+	}
+	return a.layout.AppendDescriptor(*desc)
+}
+
+// writeIndex writes the image index and all of its manifests, manifests are written after their blobs,
+// therefore a manifest which is already in the archive is complete.
+func (a *archive) writeIndex(idx v1.ImageIndex) (*v1.Descriptor, error) {
+	desc, raw, err := manifestDescriptor(idx)
+	if err != nil {
+		return nil, err
+	}
+	if a.hasBlob(desc.Digest) {
+		return desc, nil
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range manifest.Manifests {
+		switch {
+		case a.hasBlob(child.Digest):
+			continue
+		case child.MediaType.IsIndex():
+			ii, err := idx.ImageIndex(child.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := a.writeIndex(ii); err != nil {
+				return nil, err
+			}
+		case child.MediaType.IsImage():
+			img, err := idx.Image(child.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := a.writeImage(img); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unable to write manifest %q with media type %q to archive", child.Digest, child.MediaType)
+		}
+	}
+	return desc, a.writeBlob(desc.Digest, bytesOpener(raw))
+}
+
+// writeImage writes the layers, the config and the manifest of the image
+func (a *archive) writeImage(img v1.Image) (*v1.Descriptor, error) {
+	desc, raw, err := manifestDescriptor(img)
+	if err != nil {
+		return nil, err
+	}
+	if a.hasBlob(desc.Digest) {
+		return desc, nil
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		if err := a.writeBlob(digest, layer.Compressed); err != nil {
+			return nil, err
+		}
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		return nil, err
+	}
+	config, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := a.writeBlob(configName, bytesOpener(config)); err != nil {
+		return nil, err
+	}
+	return desc, a.writeBlob(desc.Digest, bytesOpener(raw))
+}
+
+// manifestDescriptor returns the descriptor and the raw manifest of an image or image index
+func manifestDescriptor(t interface {
+	RawManifest() ([]byte, error)
+	MediaType() (types.MediaType, error)
+}) (*v1.Descriptor, []byte, error) {
+	raw, err := t.RawManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	mediaType, err := t.MediaType()
+	if err != nil {
+		return nil, nil, err
+	}
+	digest, size, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &v1.Descriptor{MediaType: mediaType, Size: size, Digest: digest}, raw, nil
+}
+
+func bytesOpener(b []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+func (a *archive) blobPath(digest v1.Hash) string {
+	return filepath.Join(string(a.layout), "blobs", digest.Algorithm, digest.Hex)
+}
+
+func (a *archive) hasBlob(digest v1.Hash) bool {
+	_, err := os.Stat(a.blobPath(digest))
+	return err == nil
+}
+
+// writeBlob writes the blob unless the archive already contains it,
+// it is written to a temporary file and verified before it is moved to its final path.
+func (a *archive) writeBlob(digest v1.Hash, open func() (io.ReadCloser, error)) error {
+	if a.hasBlob(digest) {
+		return nil
+	}
+	path := a.blobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), digest.Hex+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), rc)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write blob %q %w", digest, err)
+	}
+	if digest.Algorithm == "sha256" && hex.EncodeToString(hash.Sum(nil)) != digest.Hex {
+		return fmt.Errorf("blob %q has a different digest sha256:%x", digest, hash.Sum(nil))
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// unpackTar extracts the regular files and directories of the tarball into dir
+func unpackTar(tarball, dir string) error {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read tarball %q %w", tarball, err)
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("tarball %q contains the invalid path %q", tarball, hdr.Name)
+		}
+		path := filepath.Join(dir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return err
+			}
+			out, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// packTar writes all files of dir into the tarball, the tarball is replaced atomically
+func packTar(dir, tarball string) error {
+	if err := os.MkdirAll(filepath.Dir(tarball), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(tarball), filepath.Base(tarball)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	tw := tar.NewWriter(tmp)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write tarball %q %w", tarball, err)
+	}
+	return os.Rename(tmp.Name(), tarball)
+}
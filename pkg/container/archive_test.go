@@ -0,0 +1,179 @@
+package container
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorToArchive(t *testing.T) {
+	var blobReads atomic.Int64
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			blobReads.Add(1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	src := strings.TrimPrefix(srv.URL, "http://") + "/library/busybox"
+
+	idx, err := random.Index(128, 1, 2)
+	require.NoError(t, err)
+	img, err := random.Image(128, 2)
+	require.NoError(t, err)
+	push := func(tag string, taggable remote.Taggable) {
+		ref, err := name.ParseReference(src + ":" + tag)
+		require.NoError(t, err)
+		require.NoError(t, remote.Push(ref, taggable))
+	}
+	push("1.0", idx)
+	push("1.1", img)
+	push("2.0", img)
+
+	dir := t.TempDir()
+	layoutPath := filepath.Join(dir, "layout")
+	tarball := filepath.Join(dir, "export", "bundle.tar")
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source: src,
+				Destinations: []apiv1.Destination{
+					{Destination: "oci-layout://" + layoutPath},
+					{Destination: "tar://" + tarball},
+				},
+				Match: apiv1.Match{Semver: new("< 2.0")},
+			},
+		},
+	}
+	require.NoError(t, config.Validate())
+
+	m := New(slog.New(slog.DiscardHandler), config, nil)
+	require.NoError(t, m.Mirror(context.Background()))
+	require.Positive(t, blobReads.Load())
+
+	refs := func(path string) map[string]v1.Hash {
+		l, err := layout.FromPath(path)
+		require.NoError(t, err)
+		ii, err := l.ImageIndex()
+		require.NoError(t, err)
+		manifest, err := ii.IndexManifest()
+		require.NoError(t, err)
+		refs := make(map[string]v1.Hash)
+		for _, desc := range manifest.Manifests {
+			refs[desc.Annotations[annotationRefName]] = desc.Digest
+		}
+		return refs
+	}
+	unpacked := func() string {
+		dir := t.TempDir()
+		require.NoError(t, unpackTar(tarball, dir))
+		return dir
+	}
+	idxDigest, err := idx.Digest()
+	require.NoError(t, err)
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+	want := map[string]v1.Hash{src + ":1.0": idxDigest, src + ":1.1": imgDigest}
+	require.Equal(t, want, refs(layoutPath))
+	require.Equal(t, want, refs(unpacked()))
+
+	// all blobs of the image index are in the layout
+	l, err := layout.FromPath(layoutPath)
+	require.NoError(t, err)
+	written, err := l.ImageIndex()
+	require.NoError(t, err)
+	child, err := written.ImageIndex(idxDigest)
+	require.NoError(t, err)
+	manifest, err := child.IndexManifest()
+	require.NoError(t, err)
+	for _, desc := range manifest.Manifests {
+		image, err := child.Image(desc.Digest)
+		require.NoError(t, err)
+		layers, err := image.Layers()
+		require.NoError(t, err)
+		for _, layer := range layers {
+			_, err := layer.Compressed()
+			require.NoError(t, err)
+		}
+	}
+
+	// the second run neither reads blobs nor rewrites the tarball
+	blobReads.Store(0)
+	before, err := os.Stat(tarball)
+	require.NoError(t, err)
+	m = New(slog.New(slog.DiscardHandler), config, nil)
+	m.SetDryRun(true)
+	require.NoError(t, m.Mirror(context.Background()))
+	for _, action := range m.Plan() {
+		require.Equal(t, OperationSkip, action.Operation, action.Destination)
+	}
+	require.NoError(t, New(slog.New(slog.DiscardHandler), config, nil).Mirror(context.Background()))
+	require.Zero(t, blobReads.Load())
+	after, err := os.Stat(tarball)
+	require.NoError(t, err)
+	require.Equal(t, before.ModTime(), after.ModTime())
+
+	// a new tag of an image which is already in the archive is added without reading its blobs
+	config.Images[0].Match = apiv1.Match{AllTags: true}
+	m = New(slog.New(slog.DiscardHandler), config, nil)
+	require.NoError(t, m.Mirror(context.Background()))
+	require.Zero(t, blobReads.Load())
+	want[src+":2.0"] = imgDigest
+	require.Equal(t, want, refs(layoutPath))
+	require.Equal(t, want, refs(unpacked()))
+}
+
+func TestArchiveSourceAnnotation(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer srv.Close()
+	src := strings.TrimPrefix(srv.URL, "http://") + "/library/busybox"
+
+	img, err := random.Image(128, 1)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(src + ":1.0")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+
+	layoutPath := filepath.Join(t.TempDir(), "layout")
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source:      src,
+				Destination: "oci-layout://" + layoutPath,
+				Match:       apiv1.Match{AllTags: true},
+				Rewrite:     &apiv1.TagRewrite{Prefix: "int-"},
+			},
+		},
+	}
+	require.NoError(t, New(slog.New(slog.DiscardHandler), config, nil).Mirror(context.Background()))
+
+	l, err := layout.FromPath(layoutPath)
+	require.NoError(t, err)
+	ii, err := l.ImageIndex()
+	require.NoError(t, err)
+	manifest, err := ii.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Manifests, 1)
+	require.Equal(t, map[string]string{
+		annotationRefName: src + ":int-1.0",
+		annotationSource:  src + ":1.0",
+	}, manifest.Manifests[0].Annotations)
+}
@@ -10,6 +10,37 @@ import (
 	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
 )
 
+// mirrorKeychain resolves the credentials of an image mirror,
+// the pull keychain is used for the source registry, the push keychain for the destination registry.
+type mirrorKeychain struct {
+	source      string
+	destination string
+	pull        authn.Keychain
+	push        authn.Keychain
+}
+
+func (k *mirrorKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	switch target.RegistryStr() {
+	case k.destination:
+		// if source and destination are on the same registry, the push credentials are required
+		return k.push.Resolve(target)
+	case k.source:
+		return k.pull.Resolve(target)
+	default:
+		return authn.Anonymous, nil
+	}
+}
+
+// registryKeychain returns the credentials configured for the given registry,
+// registries without configuration fall back to the default keychain.
+func (m *mirror) registryKeychain(registryName string) authn.Keychain {
+	registry, ok := m.config.Registries[registryName]
+	if !ok {
+		return authn.DefaultKeychain
+	}
+	return newKeychain(registry.Auth)
+}
+
 func (m *mirror) ensureAuthOption(image *apiv1.ImageMirror) ([]crane.Option, error) {
 	var opts []crane.Option
 	if image == nil {
@@ -19,19 +50,26 @@ func (m *mirror) ensureAuthOption(image *apiv1.ImageMirror) ([]crane.Option, err
 		opts = append(opts, crane.Insecure)
 		image.Destination = strings.ReplaceAll(image.Destination, "http://", "")
 	}
-	dstRef, err := name.ParseReference(image.Destination)
+	srcRef, err := name.ParseReference(image.Source)
 	if err != nil {
 		return opts, err
 	}
-	registryName := dstRef.Context().Registry.Name()
-	registry, ok := m.config.Registries[registryName]
-	if !ok {
-		return opts, nil
+	srcRegistry := srcRef.Context().Registry.Name()
+	// archives on disk have no destination registry
+	var dstRegistry string
+	if _, _, ok := apiv1.ParseArchive(image.Destination); !ok {
+		dstRef, err := name.ParseReference(image.Destination)
+		if err != nil {
+			return opts, err
+		}
+		dstRegistry = dstRef.Context().Registry.Name()
 	}
-	auth := crane.WithAuth(&authn.Basic{
-		Username: registry.Auth.Username,
-		Password: registry.Auth.Password,
-	})
-	opts = append(opts, auth)
+
+	opts = append(opts, crane.WithAuthFromKeychain(&mirrorKeychain{
+		source:      srcRegistry,
+		destination: dstRegistry,
+		pull:        m.registryKeychain(srcRegistry),
+		push:        m.registryKeychain(dstRegistry),
+	}))
 	return opts, nil
 }
@@ -0,0 +1,126 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+// limiter bounds the number of concurrently running operations
+type limiter chan struct{}
+
+func newLimiter(concurrency int) limiter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return make(limiter, concurrency)
+}
+
+func (l limiter) acquire() {
+	l <- struct{}{}
+}
+
+func (l limiter) release() {
+	<-l
+}
+
+// forEach calls fn for every index in 0..n with at most as many concurrent calls as the limiter allows.
+// The log records of every call are buffered and written in index order, the returned errors are joined in index order,
+// this keeps the output deterministic regardless of the concurrency.
+func (m *mirror) forEach(ctx context.Context, l limiter, n int, fn func(m *mirror, i int) error) error {
+	if cap(l) <= 1 {
+		var errs []error
+		for i := range n {
+			if err := fn(m, i); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	var (
+		errs    = make([]error, n)
+		buffers = make([]*logBuffer, n)
+		done    = make([]chan struct{}, n)
+	)
+	for i := range n {
+		buffers[i] = &logBuffer{}
+		done[i] = make(chan struct{})
+	}
+
+	go func() {
+		for i := range n {
+			l.acquire()
+			go func() {
+				defer func() {
+					l.release()
+					close(done[i])
+				}()
+				errs[i] = fn(m.withLogger(slog.New(buffers[i].handler(m.log.Handler()))), i)
+			}()
+		}
+	}()
+
+	for i := range n {
+		<-done[i]
+		buffers[i].flush(ctx)
+	}
+	return errors.Join(errs...)
+}
+
+// withLogger returns a copy of the mirror which logs to the given logger
+func (m *mirror) withLogger(log *slog.Logger) *mirror {
+	c := *m
+	c.log = log
+	return &c
+}
+
+// logBuffer keeps log records in memory until they are flushed to their handlers
+type logBuffer struct {
+	mu      sync.Mutex
+	records []bufferedRecord
+}
+
+type bufferedRecord struct {
+	handler slog.Handler
+	record  slog.Record
+}
+
+func (b *logBuffer) handler(h slog.Handler) slog.Handler {
+	return &bufferHandler{buffer: b, handler: h}
+}
+
+func (b *logBuffer) flush(ctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.records {
+		_ = r.handler.Handle(ctx, r.record)
+	}
+	b.records = nil
+}
+
+// bufferHandler is a slog.Handler which writes all records to a logBuffer
+type bufferHandler struct {
+	buffer  *logBuffer
+	handler slog.Handler
+}
+
+func (h *bufferHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *bufferHandler) Handle(_ context.Context, r slog.Record) error {
+	h.buffer.mu.Lock()
+	defer h.buffer.mu.Unlock()
+	h.buffer.records = append(h.buffer.records, bufferedRecord{handler: h.handler, record: r.Clone()})
+	return nil
+}
+
+func (h *bufferHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &bufferHandler{buffer: h.buffer, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *bufferHandler) WithGroup(name string) slog.Handler {
+	return &bufferHandler{buffer: h.buffer, handler: h.handler.WithGroup(name)}
+}
@@ -0,0 +1,88 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForEachKeepsLogAndErrorOrder(t *testing.T) {
+	var buf bytes.Buffer
+	m := &mirror{
+		log: slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		})).WithGroup("mirror"),
+	}
+
+	var (
+		running    atomic.Int32
+		maxRunning atomic.Int32
+	)
+	err := m.forEach(context.Background(), newLimiter(4), 20, func(m *mirror, i int) error {
+		current := running.Add(1)
+		defer running.Add(-1)
+		for {
+			seen := maxRunning.Load()
+			if current <= seen || maxRunning.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+
+		m.log.Info("start", "index", i)
+		time.Sleep(time.Duration(rand.IntN(5)) * time.Millisecond)
+		m.log.With("phase", "end").Info("end", "index", i)
+		if i%5 == 0 {
+			return fmt.Errorf("error %d", i)
+		}
+		return nil
+	})
+	require.Error(t, err)
+	require.LessOrEqual(t, maxRunning.Load(), int32(4))
+
+	var (
+		wantLog  []string
+		wantErrs []string
+	)
+	for i := range 20 {
+		wantLog = append(wantLog,
+			fmt.Sprintf("level=INFO msg=start mirror.index=%d", i),
+			fmt.Sprintf("level=INFO msg=end mirror.phase=end mirror.index=%d", i),
+		)
+		if i%5 == 0 {
+			wantErrs = append(wantErrs, fmt.Sprintf("error %d", i))
+		}
+	}
+	require.Equal(t, strings.Join(wantLog, "\n")+"\n", buf.String())
+	require.Equal(t, strings.Join(wantErrs, "\n"), err.Error())
+}
+
+func TestForEachSequential(t *testing.T) {
+	m := &mirror{
+		log: slog.New(slog.DiscardHandler),
+	}
+
+	var order []int
+	err := m.forEach(context.Background(), newLimiter(1), 3, func(m *mirror, i int) error {
+		order = append(order, i)
+		if i == 1 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	require.EqualError(t, err, "failed")
+	require.Equal(t, []int{0, 1, 2}, order)
+}
@@ -0,0 +1,134 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+)
+
+// Import pushes the images of an archive written by Mirror to the registry destinations of the configured images.
+// The archive takes the place of the source registry, images are matched by the source reference recorded in the archive,
+// match, rewrite and platforms of the image are applied to the source tags as if they were mirrored from the source registry.
+// The location is either an oci-layout:// or tar:// destination or a path, directories are read as OCI image layout, files as tarball.
+func (m *mirror) Import(ctx context.Context, location string) error {
+	format, path, ok := apiv1.ParseArchive(location)
+	if !ok {
+		info, err := os.Stat(location)
+		if err != nil {
+			return fmt.Errorf("unable to open archive %q %w", location, err)
+		}
+		format, path = apiv1.ArchiveTar, location
+		if info.IsDir() {
+			format = apiv1.ArchiveOCILayout
+		}
+	}
+	a, err := openArchive(format, path, false)
+	if err != nil {
+		return fmt.Errorf("unable to open archive %q %w", location, err)
+	}
+	defer func() {
+		_ = a.close()
+	}()
+
+	archived, err := a.images()
+	if err != nil {
+		return fmt.Errorf("unable to read archive %q %w", location, err)
+	}
+	m.log.Info("read archive", "archive", location, "repositories", len(archived))
+
+	var (
+		errs     []error
+		imported = make(map[string]bool)
+	)
+	for _, image := range m.imageMirrors() {
+		if _, _, ok := apiv1.ParseArchive(image.Destination); ok {
+			continue
+		}
+		srcRef, err := name.ParseReference(image.Source)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		repository := srcRef.Context().Name()
+		tags, ok := archived[repository]
+		if !ok {
+			m.log.Debug("archive does not contain images of source", "source", image.Source)
+			continue
+		}
+		imported[repository] = true
+
+		opts, err := m.ensureAuthOption(&image)
+		if err != nil {
+			m.log.Warn("unable detect auth, continue unauthenticated", "error", err)
+		}
+		opts = append(opts, crane.WithContext(ctx))
+
+		tagsToCopy, err := m.selectTags(image, slices.Sorted(maps.Keys(tags)))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, src := range slices.Sorted(maps.Keys(tagsToCopy)) {
+			desc := tags[strings.TrimPrefix(src, image.Source+":")]
+			err := m.importTag(image, a, desc, src, tagsToCopy[src], opts)
+			if err != nil {
+				m.metrics.failedImage(image.Source)
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	for _, repository := range slices.Sorted(maps.Keys(archived)) {
+		if !imported[repository] {
+			m.log.Warn("archived images are not imported, no image is configured for their source", "source", repository)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// importTag pushes a single image of the archive to the destination tag
+func (m *mirror) importTag(image apiv1.ImageMirror, a *archive, desc v1.Descriptor, src, dst string, opts []crane.Option) error {
+	o := crane.GetOptions(opts...)
+	dstRef, err := name.ParseReference(dst, o.Name...)
+	if err != nil {
+		return err
+	}
+
+	m.log.Info("import from", "source", src, "destination", dst)
+	existing, err := crane.Digest(dst, opts...)
+	if err != nil {
+		existing = ""
+	}
+	if m.immutableTag(image, src, dst, existing) {
+		return nil
+	}
+
+	img, err := a.read(desc)
+	if err != nil {
+		m.log.Error("unable to read image from archive", "image", src, "error", err)
+		return err
+	}
+	if len(image.Platforms) > 0 {
+		img, err = m.reducePlatforms(src, img, image.Platforms)
+		if err != nil {
+			return err
+		}
+		if img == nil {
+			return nil
+		}
+	}
+
+	return m.writeTag(image, src, dst, existing, img, func() error {
+		return remote.Push(dstRef, img, o.Remote...)
+	})
+}
@@ -0,0 +1,174 @@
+package container
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImport(t *testing.T) {
+	newRegistry := func() string {
+		srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+		t.Cleanup(srv.Close)
+		return strings.TrimPrefix(srv.URL, "http://")
+	}
+	srcRegistry, dstRegistry := newRegistry(), newRegistry()
+	srcBusybox := srcRegistry + "/library/busybox"
+	srcAlpine := srcRegistry + "/library/alpine"
+	dstBusybox := dstRegistry + "/library/busybox"
+
+	digests := make(map[string]string)
+	for _, ref := range []string{srcBusybox + ":1.0", srcBusybox + ":1.1", srcBusybox + ":2.0", srcAlpine + ":3.19"} {
+		idx, err := random.Index(128, 1, 2)
+		require.NoError(t, err)
+		r, err := name.ParseReference(ref)
+		require.NoError(t, err)
+		require.NoError(t, remote.WriteIndex(r, idx))
+		digest, err := idx.Digest()
+		require.NoError(t, err)
+		digests[ref] = digest.String()
+	}
+
+	dir := t.TempDir()
+	tarball := filepath.Join(dir, "bundle.tar")
+	layoutPath := filepath.Join(dir, "layout")
+	export := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source: srcBusybox,
+				Destinations: []apiv1.Destination{
+					{Destination: "tar://" + tarball},
+					{Destination: "oci-layout://" + layoutPath},
+				},
+				Match: apiv1.Match{AllTags: true},
+			},
+			{Source: srcAlpine, Destination: "tar://" + tarball, Match: apiv1.Match{AllTags: true}},
+		},
+	}
+	require.NoError(t, New(slog.New(slog.DiscardHandler), export, nil).Mirror(context.Background()))
+
+	// alpine is archived but not configured for the import
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{Source: srcBusybox, Destination: dstBusybox, Match: apiv1.Match{Semver: new(">= 1.1")}},
+		},
+	}
+	require.NoError(t, config.Validate())
+
+	m := New(slog.New(slog.DiscardHandler), config, nil)
+	m.SetDryRun(true)
+	require.NoError(t, m.Import(context.Background(), "tar://"+tarball))
+	require.Equal(t, []Action{
+		{Operation: OperationCopy, Source: srcBusybox + ":1.1", Destination: dstBusybox + ":1.1"},
+		{Operation: OperationCopy, Source: srcBusybox + ":2.0", Destination: dstBusybox + ":2.0"},
+	}, m.Plan())
+
+	require.NoError(t, New(slog.New(slog.DiscardHandler), config, nil).Import(context.Background(), tarball))
+	tags, err := crane.ListTags(dstBusybox)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.1", "2.0"}, tags)
+	for _, tag := range tags {
+		digest, err := crane.Digest(dstBusybox + ":" + tag)
+		require.NoError(t, err)
+		require.Equal(t, digests[srcBusybox+":"+tag], digest)
+	}
+
+	// present tags are skipped, the layout directory is imported as well
+	m = New(slog.New(slog.DiscardHandler), config, nil)
+	m.SetDryRun(true)
+	require.NoError(t, m.Import(context.Background(), layoutPath))
+	require.Equal(t, []Action{
+		{Operation: OperationSkip, Source: srcBusybox + ":1.1", Destination: dstBusybox + ":1.1", Digest: digests[srcBusybox+":1.1"]},
+		{Operation: OperationSkip, Source: srcBusybox + ":2.0", Destination: dstBusybox + ":2.0", Digest: digests[srcBusybox+":2.0"]},
+	}, m.Plan())
+
+	require.Error(t, m.Import(context.Background(), "oci-layout://"+filepath.Join(dir, "missing")))
+}
+
+func TestImportRewrittenTags(t *testing.T) {
+	newRegistry := func() string {
+		srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+		t.Cleanup(srv.Close)
+		return strings.TrimPrefix(srv.URL, "http://")
+	}
+	srcRegistry, dstRegistry := newRegistry(), newRegistry()
+	src := srcRegistry + "/library/busybox"
+	dst := dstRegistry + "/library/busybox"
+
+	for _, tag := range []string{"1.0", "1.1"} {
+		img, err := random.Image(128, 1)
+		require.NoError(t, err)
+		require.NoError(t, crane.Push(img, src+":"+tag))
+	}
+
+	layoutPath := filepath.Join(t.TempDir(), "layout")
+	rewrite := &apiv1.TagRewrite{Prefix: "int-"}
+	export := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{Source: src, Destination: "oci-layout://" + layoutPath, Match: apiv1.Match{AllTags: true}, Rewrite: rewrite},
+		},
+	}
+	require.NoError(t, New(slog.New(slog.DiscardHandler), export, nil).Mirror(context.Background()))
+
+	tests := []struct {
+		name  string
+		match apiv1.Match
+		want  []Action
+	}{
+		{
+			name:  "explicit source tags",
+			match: apiv1.Match{Tags: []string{"1.0"}},
+			want: []Action{
+				{Operation: OperationCopy, Source: src + ":1.0", Destination: dst + ":int-1.0"},
+			},
+		},
+		{
+			name:  "all tags are rewritten once",
+			match: apiv1.Match{AllTags: true},
+			want: []Action{
+				{Operation: OperationCopy, Source: src + ":1.0", Destination: dst + ":int-1.0"},
+				{Operation: OperationCopy, Source: src + ":1.1", Destination: dst + ":int-1.1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := apiv1.Config{
+				Images: []apiv1.ImageMirror{
+					{Source: src, Destination: dst, Match: tt.match, Rewrite: rewrite},
+				},
+			}
+			require.NoError(t, config.Validate())
+
+			m := New(slog.New(slog.DiscardHandler), config, nil)
+			m.SetDryRun(true)
+			require.NoError(t, m.Import(context.Background(), layoutPath))
+			require.Equal(t, tt.want, m.Plan())
+		})
+	}
+
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{Source: src, Destination: dst, Match: apiv1.Match{Tags: []string{"1.0"}}, Rewrite: rewrite},
+		},
+	}
+	require.NoError(t, New(slog.New(slog.DiscardHandler), config, nil).Import(context.Background(), layoutPath))
+	srcDigest, err := crane.Digest(src + ":1.0")
+	require.NoError(t, err)
+	dstDigest, err := crane.Digest(dst + ":int-1.0")
+	require.NoError(t, err)
+	require.Equal(t, srcDigest, dstDigest)
+}
@@ -0,0 +1,106 @@
+package container
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+)
+
+// newKeychain returns the keychain for the auth of a registry, an empty auth falls back to the default keychain
+func newKeychain(auth apiv1.RegistryAuth) authn.Keychain {
+	switch {
+	case auth == (apiv1.RegistryAuth{}):
+		return authn.DefaultKeychain
+	case auth.DockerConfig != "":
+		return &dockerConfigKeychain{path: auth.DockerConfig}
+	case auth.CredentialHelper != "":
+		return &credentialHelperKeychain{helper: auth.CredentialHelper}
+	default:
+		return &staticKeychain{
+			auth: authn.FromConfig(authn.AuthConfig{
+				Username:      auth.Username,
+				Password:      auth.Password,
+				IdentityToken: auth.IdentityToken,
+				RegistryToken: auth.RegistryToken,
+			}),
+		}
+	}
+}
+
+// staticKeychain always resolves to the same authenticator
+type staticKeychain struct {
+	auth authn.Authenticator
+}
+
+func (k *staticKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return k.auth, nil
+}
+
+// dockerConfigKeychain resolves the credentials from a docker config.json, the file is read on every resolve
+// to pick up rotated credentials
+type dockerConfigKeychain struct {
+	path string
+}
+
+func (k *dockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open docker config %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	cf, err := config.LoadFromReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read docker config %q %w", k.path, err)
+	}
+	cfg, err := cf.GetAuthConfig(serverURL(target))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get credentials of %q from docker config %q %w", target.RegistryStr(), k.path, err)
+	}
+	if cfg.Username == "" && cfg.Password == "" && cfg.Auth == "" && cfg.IdentityToken == "" && cfg.RegistryToken == "" {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
+
+// credentialHelperKeychain resolves the credentials with the docker-credential-<helper> binary
+type credentialHelperKeychain struct {
+	helper string
+}
+
+func (k *credentialHelperKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	creds, err := client.Get(client.NewShellProgramFunc("docker-credential-"+k.helper), serverURL(target))
+	if credentials.IsErrCredentialsNotFound(err) {
+		return authn.Anonymous, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %q failed for %q %w", k.helper, target.RegistryStr(), err)
+	}
+	// identity tokens are stored with this username by convention
+	if creds.Username == "<token>" {
+		return authn.FromConfig(authn.AuthConfig{IdentityToken: creds.Secret}), nil
+	}
+	return authn.FromConfig(authn.AuthConfig{Username: creds.Username, Password: creds.Secret}), nil
+}
+
+// serverURL returns the key of the registry in docker configs and credential helpers,
+// docker hub is stored with its legacy v1 URL
+func serverURL(target authn.Resource) string {
+	if target.RegistryStr() == name.DefaultRegistry {
+		return authn.DefaultAuthKey
+	}
+	return target.RegistryStr()
+}
@@ -0,0 +1,99 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKeychain(t *testing.T) {
+	dockerConfig := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(dockerConfig, []byte(`{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOmh1YnNlY3JldA=="},
+		"r.example.com": {"identitytoken": "refresh"}
+	}
+}`), 0600)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		auth     apiv1.RegistryAuth
+		registry string
+		want     authn.AuthConfig
+		wantErr  bool
+	}{
+		{
+			name:     "username and password",
+			auth:     apiv1.RegistryAuth{Username: "user", Password: "secret"},
+			registry: "r.example.com",
+			want:     authn.AuthConfig{Username: "user", Password: "secret"},
+		},
+		{
+			name:     "registry token",
+			auth:     apiv1.RegistryAuth{RegistryToken: "bearer"},
+			registry: "r.example.com",
+			want:     authn.AuthConfig{RegistryToken: "bearer"},
+		},
+		{
+			name:     "docker hub from docker config",
+			auth:     apiv1.RegistryAuth{DockerConfig: dockerConfig},
+			registry: name.DefaultRegistry,
+			want:     authn.AuthConfig{Username: "hub", Password: "hubsecret"},
+		},
+		{
+			name:     "identity token from docker config",
+			auth:     apiv1.RegistryAuth{DockerConfig: dockerConfig},
+			registry: "r.example.com",
+			want:     authn.AuthConfig{IdentityToken: "refresh"},
+		},
+		{
+			name:     "registry missing in docker config",
+			auth:     apiv1.RegistryAuth{DockerConfig: dockerConfig},
+			registry: "other.example.com",
+			want:     authn.AuthConfig{},
+		},
+		{
+			name:     "missing docker config",
+			auth:     apiv1.RegistryAuth{DockerConfig: filepath.Join(t.TempDir(), "missing.json")},
+			registry: "r.example.com",
+			wantErr:  true,
+		},
+		{
+			name:     "missing credential helper",
+			auth:     apiv1.RegistryAuth{CredentialHelper: "oci-mirror-missing"},
+			registry: "r.example.com",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry, err := name.NewRegistry(tt.registry)
+			require.NoError(t, err)
+			auth, err := newKeychain(tt.auth).Resolve(registry)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			got, err := auth.Authorization()
+			require.NoError(t, err)
+			require.Equal(t, tt.want.Username, got.Username)
+			require.Equal(t, tt.want.Password, got.Password)
+			require.Equal(t, tt.want.IdentityToken, got.IdentityToken)
+			require.Equal(t, tt.want.RegistryToken, got.RegistryToken)
+		})
+	}
+
+	t.Setenv("DOCKER_CONFIG", filepath.Dir(dockerConfig))
+	auth, err := newKeychain(apiv1.RegistryAuth{}).Resolve(name.MustParseReference("r.example.com/abc").Context())
+	require.NoError(t, err)
+	got, err := auth.Authorization()
+	require.NoError(t, err)
+	require.Equal(t, "refresh", got.IdentityToken, "the default keychain of the environment is used")
+}
@@ -0,0 +1,132 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// manifestKind is the kind of content a manifest describes
+type manifestKind string
+
+const (
+	// manifestKindIndex is an OCI image index or a Docker manifest list
+	manifestKindIndex = manifestKind("index")
+	// manifestKindImage is an OCI or Docker v2 schema 2 image manifest with an image config
+	manifestKindImage = manifestKind("image")
+	// manifestKindArtifact is an OCI manifest which does not describe a container image, e.g. a helm chart or a signature
+	manifestKindArtifact = manifestKind("artifact")
+	// manifestKindSchema1 is a deprecated Docker v2 schema 1 manifest
+	manifestKindSchema1 = manifestKind("schema1")
+	// manifestKindUnknown is a manifest with an unsupported media type
+	manifestKindUnknown = manifestKind("unknown")
+)
+
+// classifyManifest detects the kind of manifest by the media type of its descriptor,
+// image manifests are further distinguished from artifacts by their artifact type and config media type.
+func classifyManifest(mediaType types.MediaType, rawManifest []byte) manifestKind {
+	switch {
+	case mediaType.IsIndex():
+		return manifestKindIndex
+	case mediaType.IsSchema1():
+		return manifestKindSchema1
+	case mediaType.IsImage():
+		var manifest struct {
+			ArtifactType string `json:"artifactType,omitempty"`
+			Config       struct {
+				MediaType types.MediaType `json:"mediaType"`
+			} `json:"config"`
+		}
+		if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+			return manifestKindUnknown
+		}
+		if manifest.ArtifactType != "" || !manifest.Config.MediaType.IsConfig() {
+			return manifestKindArtifact
+		}
+		return manifestKindImage
+	default:
+		return manifestKindUnknown
+	}
+}
+
+// convertSchema1 converts a Docker v2 schema 1 image into a Docker v2 schema 2 image,
+// the layers are downloaded to compute their diff ids.
+func convertSchema1(desc *remote.Descriptor) (v1.Image, error) {
+	s1, err := desc.Schema1()
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest struct {
+		Architecture string `json:"architecture"`
+		FSLayers     []struct {
+			BlobSum v1.Hash `json:"blobSum"`
+		} `json:"fsLayers"`
+		History []struct {
+			V1Compatibility string `json:"v1Compatibility"`
+		} `json:"history"`
+	}
+	if err := json.Unmarshal(desc.Manifest, &manifest); err != nil {
+		return nil, fmt.Errorf("unable to decode schema 1 manifest %w", err)
+	}
+	if len(manifest.History) != len(manifest.FSLayers) {
+		return nil, fmt.Errorf("schema 1 manifest has %d layers but %d history entries", len(manifest.FSLayers), len(manifest.History))
+	}
+
+	cfg := &v1.ConfigFile{
+		OS:           "linux",
+		Architecture: manifest.Architecture,
+	}
+
+	// layers and history are ordered from the newest to the oldest, the newest history entry contains the image config
+	var layers []v1.Layer
+	for i := len(manifest.FSLayers) - 1; i >= 0; i-- {
+		var compatibility struct {
+			Created   v1.Time   `json:"created"`
+			OS        string    `json:"os,omitempty"`
+			Config    v1.Config `json:"config"`
+			Throwaway bool      `json:"throwaway,omitempty"`
+		}
+		if err := json.Unmarshal([]byte(manifest.History[i].V1Compatibility), &compatibility); err != nil {
+			return nil, fmt.Errorf("unable to decode schema 1 history %w", err)
+		}
+		cfg.History = append(cfg.History, v1.History{
+			Created:    compatibility.Created,
+			EmptyLayer: compatibility.Throwaway,
+		})
+		if i == 0 {
+			cfg.Config = compatibility.Config
+			cfg.Created = compatibility.Created
+			if compatibility.OS != "" {
+				cfg.OS = compatibility.OS
+			}
+		}
+		if compatibility.Throwaway {
+			continue
+		}
+		layer, err := s1.LayerByDigest(manifest.FSLayers[i].BlobSum)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+
+	img := mutate.MediaType(empty.Image, types.DockerManifestSchema2)
+	img = mutate.ConfigMediaType(img, types.DockerConfigJSON)
+	img, err = mutate.AppendLayers(img, layers...)
+	if err != nil {
+		return nil, err
+	}
+	// AppendLayers adds history entries, the converted history replaces them
+	layered, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg.RootFS = layered.RootFS
+	return mutate.ConfigFile(img, cfg)
+}
@@ -0,0 +1,275 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyManifest(t *testing.T) {
+	tests := []struct {
+		name      string
+		mediaType types.MediaType
+		manifest  string
+		want      manifestKind
+	}{
+		{
+			name:      "oci index",
+			mediaType: types.OCIImageIndex,
+			manifest:  `{"schemaVersion":2,"manifests":[]}`,
+			want:      manifestKindIndex,
+		},
+		{
+			name:      "docker manifest list",
+			mediaType: types.DockerManifestList,
+			manifest:  `{"schemaVersion":2,"manifests":[]}`,
+			want:      manifestKindIndex,
+		},
+		{
+			name:      "oci image",
+			mediaType: types.OCIManifestSchema1,
+			manifest:  `{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json"}}`,
+			want:      manifestKindImage,
+		},
+		{
+			name:      "docker image",
+			mediaType: types.DockerManifestSchema2,
+			manifest:  `{"schemaVersion":2,"config":{"mediaType":"application/vnd.docker.container.image.v1+json"}}`,
+			want:      manifestKindImage,
+		},
+		{
+			name:      "oci artifact with artifact type",
+			mediaType: types.OCIManifestSchema1,
+			manifest:  `{"schemaVersion":2,"artifactType":"application/vnd.dev.cosign.artifact.sig.v1+json","config":{"mediaType":"application/vnd.oci.empty.v1+json"}}`,
+			want:      manifestKindArtifact,
+		},
+		{
+			name:      "helm chart",
+			mediaType: types.OCIManifestSchema1,
+			manifest:  `{"schemaVersion":2,"config":{"mediaType":"application/vnd.cncf.helm.config.v1+json"}}`,
+			want:      manifestKindArtifact,
+		},
+		{
+			name:      "docker schema 1",
+			mediaType: types.DockerManifestSchema1,
+			manifest:  `{"schemaVersion":1}`,
+			want:      manifestKindSchema1,
+		},
+		{
+			name:      "docker schema 1 signed",
+			mediaType: types.DockerManifestSchema1Signed,
+			manifest:  `{"schemaVersion":1}`,
+			want:      manifestKindSchema1,
+		},
+		{
+			name:      "unknown media type",
+			mediaType: types.MediaType("application/octet-stream"),
+			manifest:  `{}`,
+			want:      manifestKindUnknown,
+		},
+		{
+			name:      "broken image manifest",
+			mediaType: types.OCIManifestSchema1,
+			manifest:  `{`,
+			want:      manifestKindUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, classifyManifest(tt.mediaType, []byte(tt.manifest)))
+		})
+	}
+}
+
+// schema1Image is a raw Docker v2 schema 1 manifest
+type schema1Image struct {
+	manifest []byte
+}
+
+func (s schema1Image) RawManifest() ([]byte, error) { return s.manifest, nil }
+func (s schema1Image) MediaType() (types.MediaType, error) {
+	return types.DockerManifestSchema1Signed, nil
+}
+
+// TestMirrorSchema1 uses an in-memory registry because the distribution registry refuses schema 1 manifests
+func TestMirrorSchema1(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	src := host + "/library/legacy"
+	layers := make([]v1.Layer, 2)
+	for i := range layers {
+		l, err := random.Layer(128, types.DockerLayer)
+		require.NoError(t, err)
+		repo, err := name.NewRepository(src)
+		require.NoError(t, err)
+		require.NoError(t, remote.WriteLayer(repo, l))
+		layers[i] = l
+	}
+	older, err := layers[0].Digest()
+	require.NoError(t, err)
+	newer, err := layers[1].Digest()
+	require.NoError(t, err)
+
+	compatibility := func(v map[string]any) string {
+		raw, err := json.Marshal(v)
+		require.NoError(t, err)
+		return string(raw)
+	}
+	// layers and history are ordered from the newest to the oldest, the empty layer is a throwaway
+	manifest, err := json.Marshal(map[string]any{
+		"schemaVersion": 1,
+		"name":          "library/legacy",
+		"tag":           "1.0",
+		"architecture":  "amd64",
+		"fsLayers": []map[string]string{
+			{"blobSum": newer.String()},
+			{"blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"},
+			{"blobSum": older.String()},
+		},
+		"history": []map[string]string{
+			{"v1Compatibility": compatibility(map[string]any{"id": "3", "os": "linux", "created": "2020-01-03T00:00:00Z", "config": map[string]any{"Cmd": []string{"/bin/sh"}}})},
+			{"v1Compatibility": compatibility(map[string]any{"id": "2", "created": "2020-01-02T00:00:00Z", "throwaway": true})},
+			{"v1Compatibility": compatibility(map[string]any{"id": "1", "created": "2020-01-01T00:00:00Z"})},
+		},
+	})
+	require.NoError(t, err)
+	srcRef, err := name.ParseReference(src + ":1.0")
+	require.NoError(t, err)
+	require.NoError(t, remote.Put(srcRef, schema1Image{manifest: manifest}))
+
+	tests := []struct {
+		name    string
+		policy  apiv1.Schema1Policy
+		wantErr bool
+		want    bool
+	}{
+		{name: "skip by default", policy: "", want: false},
+		{name: "reject", policy: apiv1.Schema1Reject, wantErr: true, want: false},
+		{name: "convert", policy: apiv1.Schema1Convert, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := host + "/converted/" + strings.ReplaceAll(tt.name, " ", "-")
+			m := New(slog.New(slog.DiscardHandler), apiv1.Config{
+				Images: []apiv1.ImageMirror{
+					{
+						Source:      src,
+						Destination: dst,
+						Match:       apiv1.Match{Tags: []string{"1.0"}},
+						Schema1:     tt.policy,
+					},
+				},
+			}, nil)
+			err := m.Mirror(context.Background())
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			dstRef, err := name.ParseReference(dst + ":1.0")
+			require.NoError(t, err)
+			img, err := remote.Image(dstRef)
+			if !tt.want {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			mediaType, err := img.MediaType()
+			require.NoError(t, err)
+			require.Equal(t, types.DockerManifestSchema2, mediaType)
+
+			got, err := img.Layers()
+			require.NoError(t, err)
+			require.Len(t, got, 2)
+			for i, l := range got {
+				digest, err := l.Digest()
+				require.NoError(t, err)
+				want, err := layers[i].Digest()
+				require.NoError(t, err)
+				require.Equal(t, want, digest)
+			}
+
+			cfg, err := img.ConfigFile()
+			require.NoError(t, err)
+			require.Equal(t, "linux", cfg.OS)
+			require.Equal(t, "amd64", cfg.Architecture)
+			require.Equal(t, []string{"/bin/sh"}, cfg.Config.Cmd)
+			require.Len(t, cfg.History, 3)
+			require.True(t, cfg.History[1].EmptyLayer)
+			require.Len(t, cfg.RootFS.DiffIDs, 2)
+		})
+	}
+}
+
+func TestMirrorUnchangedTagsAreNotRead(t *testing.T) {
+	var manifestReads atomic.Int64
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/library/busybox/manifests/") {
+			manifestReads.Add(1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	src := host + "/library/busybox"
+
+	push := func(tag string) {
+		img, err := random.Image(128, 1)
+		require.NoError(t, err)
+		require.NoError(t, crane.Push(img, src+":"+tag))
+	}
+	push("1.0")
+	push("stable")
+
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{Source: src, Destination: host + "/mirror/busybox", Match: apiv1.Match{AllTags: true}},
+		},
+	}
+	require.NoError(t, New(slog.New(slog.DiscardHandler), config, nil).Mirror(context.Background()))
+	require.Equal(t, int64(2), manifestReads.Load())
+
+	manifestReads.Store(0)
+	m := New(slog.New(slog.DiscardHandler), config, nil)
+	m.SetDryRun(true)
+	require.NoError(t, m.Mirror(context.Background()))
+	for _, action := range m.Plan() {
+		require.Equal(t, OperationSkip, action.Operation, action.Destination)
+	}
+	require.Zero(t, manifestReads.Load())
+
+	// a moved tag is read and copied again
+	digest, err := crane.Digest(src + ":1.0")
+	require.NoError(t, err)
+	push("stable")
+	m = New(slog.New(slog.DiscardHandler), config, nil)
+	m.SetDryRun(true)
+	require.NoError(t, m.Mirror(context.Background()))
+	require.Equal(t, []Action{
+		{Operation: OperationSkip, Source: src + ":1.0", Destination: host + "/mirror/busybox:1.0", Digest: digest},
+		{Operation: OperationCopy, Source: src + ":stable", Destination: host + "/mirror/busybox:stable"},
+	}, m.Plan())
+	require.Equal(t, int64(1), manifestReads.Load())
+}
@@ -0,0 +1,163 @@
+package container
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are the prometheus metrics of mirror and purge runs, all methods are safe to be called on nil
+type Metrics struct {
+	copied      *prometheus.CounterVec
+	skipped     *prometheus.CounterVec
+	failed      *prometheus.CounterVec
+	transferred *prometheus.CounterVec
+	retries     *prometheus.CounterVec
+	purged      *prometheus.CounterVec
+	duration    *prometheus.GaugeVec
+	manifests   *prometheus.CounterVec
+}
+
+// NewMetrics creates the metrics and registers them at the given registerer
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		copied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "oci_mirror",
+			Name:      "copied_total",
+			Help:      "number of copied images and tags",
+		}, []string{"image"}),
+		skipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "oci_mirror",
+			Name:      "skipped_total",
+			Help:      "number of images and tags which were skipped because they are unchanged or immutable in the destination",
+		}, []string{"image"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "oci_mirror",
+			Name:      "failed_total",
+			Help:      "number of images and tags which failed to copy",
+		}, []string{"image"}),
+		transferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "oci_mirror",
+			Name:      "transferred_bytes_total",
+			Help:      "number of blob bytes transferred from the source",
+		}, []string{"image"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "oci_mirror",
+			Name:      "retries_total",
+			Help:      "number of retries of transient operation failures",
+		}, []string{"operation"}),
+		purged: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "oci_mirror",
+			Name:      "purged_digests_total",
+			Help:      "number of purged digests",
+		}, []string{"image"}),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "oci_mirror",
+			Name:      "image_run_duration_seconds",
+			Help:      "duration of the last mirror run per image entry",
+		}, []string{"image"}),
+		manifests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "oci_mirror",
+			Name:      "manifests_total",
+			Help:      "number of source manifests read per kind, e.g. index, image, artifact or schema1",
+		}, []string{"kind"}),
+	}
+	reg.MustRegister(m.copied, m.skipped, m.failed, m.transferred, m.retries, m.purged, m.duration, m.manifests)
+	return m
+}
+
+// SetMetrics enables the collection of metrics
+func (m *mirror) SetMetrics(metrics *Metrics) {
+	m.metrics = metrics
+}
+
+func (m *Metrics) copiedImage(image string) {
+	if m == nil {
+		return
+	}
+	m.copied.WithLabelValues(image).Inc()
+}
+
+func (m *Metrics) skippedImage(image string) {
+	if m == nil {
+		return
+	}
+	m.skipped.WithLabelValues(image).Inc()
+}
+
+func (m *Metrics) failedImage(image string) {
+	if m == nil {
+		return
+	}
+	m.failed.WithLabelValues(image).Inc()
+}
+
+func (m *Metrics) retried(operation string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(operation).Inc()
+}
+
+func (m *Metrics) purgedDigest(image string) {
+	if m == nil {
+		return
+	}
+	m.purged.WithLabelValues(image).Inc()
+}
+
+func (m *Metrics) manifest(kind manifestKind) {
+	if m == nil {
+		return
+	}
+	m.manifests.WithLabelValues(string(kind)).Inc()
+}
+
+func (m *Metrics) imageDuration(image string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.duration.WithLabelValues(image).Set(time.Since(start).Seconds())
+}
+
+// transferOption returns a crane option which counts the blob bytes read from the registries of the given image entry.
+// The counting transport wraps the transport of the given options, which skips the tls verification of insecure registries.
+func (m *Metrics) transferOption(image string, opts []crane.Option) []crane.Option {
+	if m == nil {
+		return nil
+	}
+	return []crane.Option{crane.WithTransport(&countingTransport{
+		inner:   crane.GetOptions(opts...).Transport,
+		counter: m.transferred.WithLabelValues(image),
+	})}
+}
+
+// countingTransport counts the bytes of all blob downloads
+type countingTransport struct {
+	inner   http.RoundTripper
+	counter prometheus.Counter
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || !strings.Contains(req.URL.Path, "/blobs/") {
+		return resp, err
+	}
+	resp.Body = &countingReader{ReadCloser: resp.Body, counter: t.counter}
+	return resp, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,101 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	require.NotPanics(t, func() {
+		m.copiedImage("image")
+		m.skippedImage("image")
+		m.failedImage("image")
+		m.retried("list_tags")
+		m.purgedDigest("image")
+		m.manifest(manifestKindImage)
+		m.imageDuration("image", time.Now())
+		require.Empty(t, m.transferOption("image", nil))
+	})
+}
+
+func TestMetricsRetries(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	m := &mirror{
+		log:     slog.New(slog.DiscardHandler),
+		metrics: metrics,
+	}
+
+	attempts := 0
+	err := m.withRetryPolicy("list_tags", "example/image", &RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}, func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("connection reset by peer")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, float64(2), testutil.ToFloat64(metrics.retries.WithLabelValues("list_tags")))
+}
+
+func TestCountingTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("a", 1024)))
+	}))
+	defer srv.Close()
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	counter := metrics.transferred.WithLabelValues("image")
+	client := &http.Client{Transport: &countingTransport{inner: http.DefaultTransport, counter: counter}}
+
+	for _, path := range []string{"/v2/library/alpine/blobs/sha256:abc", "/v2/library/alpine/manifests/latest"} {
+		resp, err := client.Get(srv.URL + path)
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	// only blobs are counted
+	require.Equal(t, float64(1024), testutil.ToFloat64(counter))
+}
+
+func TestMetricsInsecureRegistry(t *testing.T) {
+	// the registry uses a self-signed certificate
+	srv := httptest.NewTLSServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, crane.Push(img, host+"/library/alpine:3.20", crane.WithTransport(srv.Client().Transport)))
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	m := New(slog.New(slog.DiscardHandler), apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{Source: host + "/library/alpine", Destination: "http://" + host + "/mirror/alpine", Match: apiv1.Match{AllTags: true}},
+		},
+	}, nil)
+	m.SetMetrics(metrics)
+	require.NoError(t, m.Mirror(context.Background()))
+
+	_, err = crane.Digest(host+"/mirror/alpine:3.20", crane.WithTransport(srv.Client().Transport))
+	require.NoError(t, err)
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.copied.WithLabelValues(host+"/library/alpine")))
+}
@@ -1,14 +1,20 @@
 package container
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
-	"strings"
+	"maps"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 
 	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
 )
@@ -17,99 +23,388 @@ type mirror struct {
 	log         *slog.Logger
 	config      apiv1.Config
 	retryPolicy *RetryPolicy
+	concurrency int
+	// registryLimiters bound the concurrent operations per destination registry
+	registryLimiters map[string]limiter
+	// plan records all actions instead of performing them if set
+	plan    *plan
+	metrics *Metrics
+	// archives are the destinations on disk opened during a mirror run
+	archives *archiveSet
 }
 
 func New(log *slog.Logger, config apiv1.Config, retryPolicy *RetryPolicy) *mirror {
+	registryLimiters := make(map[string]limiter)
+	for name, registry := range config.Registries {
+		if registry.Concurrency > 0 {
+			registryLimiters[name] = newLimiter(registry.Concurrency)
+		}
+	}
 	return &mirror{
-		log:         log,
-		config:      config,
-		retryPolicy: retryPolicy,
+		log:              log,
+		config:           config,
+		retryPolicy:      retryPolicy,
+		concurrency:      1,
+		registryLimiters: registryLimiters,
+		archives:         &archiveSet{},
 	}
 }
 
+// SetConcurrency defines how many images and tags are mirrored concurrently
+func (m *mirror) SetConcurrency(concurrency int) {
+	m.concurrency = concurrency
+}
+
+// imageMirrors returns all image mirrors of the configuration with a single destination each
+func (m *mirror) imageMirrors() []apiv1.ImageMirror {
+	var mirrors []apiv1.ImageMirror
+	for _, image := range m.config.Images {
+		mirrors = append(mirrors, image.Mirrors()...)
+	}
+	return mirrors
+}
+
+// destinationLimiter returns the limiter of the registry of the given destination, nil if it is not limited
+func (m *mirror) destinationLimiter(destination string) limiter {
+	ref, err := name.ParseReference(destination)
+	if err != nil {
+		return nil
+	}
+	return m.registryLimiters[ref.Context().Registry.Name()]
+}
+
 func (m *mirror) Mirror(ctx context.Context) error {
+	m.log.Debug("start mirroring images", "retryPolicy", m.retryPolicy, "concurrency", m.concurrency)
+
 	var (
-		errs []error
+		images = newLimiter(m.concurrency)
+		tags   = newLimiter(m.concurrency)
 	)
-	m.log.Debug("start mirroring images", "retryPolicy", m.retryPolicy)
-	for _, image := range m.config.Images {
-		var (
-			err  error
-			opts []crane.Option
-		)
+	err := m.forEach(ctx, images, len(m.config.Images), func(m *mirror, i int) error {
+		return m.mirrorImage(ctx, tags, m.config.Images[i])
+	})
+	return errors.Join(err, m.closeArchives())
+}
+
+// mirrorTarget is a single destination of an image mirror
+type mirrorTarget struct {
+	image      apiv1.ImageMirror
+	opts       []crane.Option
+	limiter    limiter
+	tagsToCopy tagsToCopy
+
+	mu sync.Mutex
+	// referrers are the digests whose referrers are mirrored
+	referrers map[string]bool
+}
+
+// claimReferrers returns true if the referrers of the digest are not mirrored yet by another tag of the same digest
+func (t *mirrorTarget) claimReferrers(digest string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.referrers[digest] {
+		return false
+	}
+	if t.referrers == nil {
+		t.referrers = make(map[string]bool)
+	}
+	t.referrers[digest] = true
+	return true
+}
+
+// sourceManifest is the manifest of a source tag, it is read at most once for all destinations
+type sourceManifest struct {
+	src string
+	// digest is the digest of the source tag read with a HEAD request, empty if not read yet
+	digest    string
+	desc      *remote.Descriptor
+	kind      manifestKind
+	err       error
+	converted v1.Image
+}
+
+func (m *mirror) mirrorImage(ctx context.Context, tags limiter, entry apiv1.ImageMirror) error {
+	start := time.Now()
+	defer m.metrics.imageDuration(entry.Source, start)
 
-		opts, err = m.ensureAuthOption(&image)
+	var targets []*mirrorTarget
+	for _, image := range entry.Mirrors() {
+		opts, err := m.ensureAuthOption(&image)
 		if err != nil {
 			m.log.Warn("unable detect auth, continue unauthenticated", "error", err)
 		}
 		opts = append(opts, crane.WithContext(ctx))
+		opts = append(opts, m.metrics.transferOption(image.Source, opts)...)
 
 		m.log.Info("consider mirror from", "source", image.Source, "destination", image.Destination)
+		targets = append(targets, &mirrorTarget{
+			image:   image,
+			opts:    opts,
+			limiter: m.destinationLimiter(image.Destination),
+		})
+	}
 
-		if image.Match.AllTags {
-			m.log.Info("mirror all tags from", "source", image.Source, "destination", image.Destination)
-			err := m.withRetry("copy_repository", image.Source, func() error {
-				return crane.CopyRepository(image.Source, image.Destination, opts...)
-			})
-			if err != nil {
-				m.log.Error("unable to copy all images", "image", image.Source, "error", err)
-				errs = append(errs, err)
-			}
-			continue
-		}
+	// the source tags are listed once for all destinations
+	srcTags, err := m.listTags(entry.Source, targets[0].opts)
+	if err != nil {
+		return err
+	}
 
-		tagsToCopy, err := m.getTagsToCopy(image, opts)
+	var (
+		errs    []error
+		sources = make(map[string]bool)
+	)
+	for _, target := range targets {
+		tagsToCopy, err := m.selectTags(target.image, srcTags)
 		if err != nil {
 			errs = append(errs, err)
 			continue
 		}
+		target.tagsToCopy = tagsToCopy
+		for src := range tagsToCopy {
+			sources[src] = true
+		}
+	}
 
-		for src, dst := range tagsToCopy {
-			if !strings.HasSuffix(dst, ":latest") {
-				opts = append(opts, crane.WithNoClobber(false))
-			}
-			m.log.Info("mirror from", "source", src, "destination", dst)
-			var rawmanifest []byte
-			err := m.withRetry("read_manifest", src, func() error {
-				var err2 error
-				rawmanifest, err2 = crane.Manifest(src, opts...)
-				return err2
-			})
-			if err != nil {
-				m.log.Error("unable to read image manifest", "error", err)
-				errs = append(errs, err)
+	sorted := slices.Sorted(maps.Keys(sources))
+	err = m.forEach(ctx, tags, len(sorted), func(m *mirror, i int) error {
+		var (
+			errs   []error
+			source = &sourceManifest{src: sorted[i]}
+		)
+		for _, target := range targets {
+			dst, ok := target.tagsToCopy[source.src]
+			if !ok {
 				continue
 			}
-			manifest := v1.Manifest{}
-			if err := json.Unmarshal(rawmanifest, &manifest); err != nil {
-				m.log.Error("unable to decode image manifest", "error", err)
+			err := func() error {
+				if target.limiter != nil {
+					target.limiter.acquire()
+					defer target.limiter.release()
+				}
+				err := m.mirrorTag(target.image, source, dst, target.opts)
+				if err != nil || !target.image.IncludeReferrers {
+					return err
+				}
+				return m.mirrorReferrers(target, source)
+			}()
+			if err != nil {
+				m.metrics.failedImage(target.image.Source)
 				errs = append(errs, err)
-				continue
-			}
-			if manifest.SchemaVersion < 2 {
-				m.log.Warn("image manifest scheme version to low, ignoring", "image", src, "scheme version", manifest.SchemaVersion)
-				continue
 			}
+		}
+		return errors.Join(errs...)
+	})
+	return errors.Join(append(errs, err)...)
+}
 
-			_, err = crane.Digest(dst, opts...)
-			if err == nil && !strings.HasSuffix(dst, ":latest") {
-				m.log.Info("image already exists, skip copy", "image", dst)
-				continue
-			}
+// sourceDigest returns the digest of the source tag with a HEAD request unless the manifest was already read,
+// empty if it cannot be read, the manifest is read with a GET request then.
+func (m *mirror) sourceDigest(source *sourceManifest, opts []crane.Option) string {
+	if source.desc != nil {
+		return source.desc.Digest.String()
+	}
+	if source.digest != "" {
+		return source.digest
+	}
+	o := crane.GetOptions(opts...)
+	srcRef, err := name.ParseReference(source.src, o.Name...)
+	if err != nil {
+		return ""
+	}
+	var desc *v1.Descriptor
+	err = m.withRetry("head_manifest", source.src, func() error {
+		var err2 error
+		desc, err2 = remote.Head(srcRef, o.Remote...)
+		return err2
+	})
+	if err != nil {
+		m.log.Debug("unable to read image digest, read the manifest instead", "image", source.src, "error", err)
+		return ""
+	}
+	source.digest = desc.Digest.String()
+	return source.digest
+}
 
-			m.log.Info("copy image", "source", src, "destination", dst)
-			err = m.withRetry("copy_image", src, func() error {
-				return crane.Copy(src, dst, opts...)
-			})
-			if err != nil {
-				m.log.Error("unable to copy", "source", src, "dst", dst, "error", err)
-				errs = append(errs, err)
+// readManifest reads the manifest of the source tag unless it was already read for another destination
+func (m *mirror) readManifest(source *sourceManifest, opts []crane.Option) error {
+	if source.desc != nil || source.err != nil {
+		return source.err
+	}
+	o := crane.GetOptions(opts...)
+	srcRef, err := name.ParseReference(source.src, o.Name...)
+	if err != nil {
+		source.err = err
+		return err
+	}
+	source.err = m.withRetry("read_manifest", source.src, func() error {
+		var err2 error
+		source.desc, err2 = remote.Get(srcRef, o.Remote...)
+		return err2
+	})
+	if source.err != nil {
+		m.log.Error("unable to read image manifest", "error", source.err)
+		return source.err
+	}
+
+	source.kind = classifyManifest(source.desc.MediaType, source.desc.Manifest)
+	m.log.Debug("read image manifest", "image", source.src, "kind", source.kind, "media type", source.desc.MediaType)
+	m.metrics.manifest(source.kind)
+	return nil
+}
+
+func (m *mirror) mirrorTag(image apiv1.ImageMirror, source *sourceManifest, dst string, opts []crane.Option) error {
+	var (
+		src     = source.src
+		o       = crane.GetOptions(opts...)
+		dstRef  name.Reference
+		archive *archive
+		// ref is the name of the image in the archive
+		ref string
+		err error
+	)
+	if _, _, ok := apiv1.ParseArchive(image.Destination); ok {
+		archive, err = m.archive(image.Destination)
+		if err != nil {
+			return err
+		}
+		ref, err = archiveRef(image, dst)
+	} else {
+		dstRef, err = name.ParseReference(dst, o.Name...)
+	}
+	if err != nil {
+		return err
+	}
+
+	m.log.Info("mirror from", "source", src, "destination", dst)
+	var existing string
+	if archive != nil {
+		existing, err = archive.digest(ref)
+	} else {
+		existing, err = crane.Digest(dst, opts...)
+	}
+	if err != nil {
+		existing = ""
+	}
+	if m.immutableTag(image, src, dst, existing) {
+		return nil
+	}
+	// unchanged tags are skipped without reading the source manifest, which counts against pull rate limits,
+	// images reduced to platforms differ from the source digest and are compared after the manifest was read
+	if existing != "" && image.MutableTags != apiv1.MutableTagsAlways && len(image.Platforms) == 0 {
+		if digest := m.sourceDigest(source, opts); digest == existing {
+			m.unchangedTag(image, src, dst, existing)
+			return nil
+		}
+	}
+
+	err = m.readManifest(source, opts)
+	if err != nil {
+		return err
+	}
+	desc, kind := source.desc, source.kind
+
+	var img remote.Taggable = desc
+	switch kind {
+	case manifestKindSchema1:
+		switch image.Schema1 {
+		case apiv1.Schema1Reject:
+			m.log.Error("image manifest is schema 1, rejecting", "image", src, "media type", desc.MediaType)
+			return fmt.Errorf("image manifest of %q is schema 1 with media type %q", src, desc.MediaType)
+		case apiv1.Schema1Convert:
+			if source.converted == nil {
+				m.log.Info("image manifest is schema 1, converting", "image", src, "media type", desc.MediaType)
+				source.converted, err = convertSchema1(desc)
+				if err != nil {
+					m.log.Error("unable to convert schema 1 image manifest", "image", src, "error", err)
+					return err
+				}
 			}
+			img = source.converted
+		default:
+			m.log.Warn("image manifest is schema 1, ignoring", "image", src, "media type", desc.MediaType)
+			return nil
+		}
+	case manifestKindUnknown:
+		m.log.Warn("image manifest has an unsupported media type, ignoring", "image", src, "media type", desc.MediaType)
+		return nil
+	case manifestKindIndex, manifestKindImage:
+		if len(image.Platforms) == 0 {
+			break
+		}
+		img, err = m.platformImage(src, desc, image.Platforms)
+		if err != nil {
+			return err
+		}
+		if img == nil {
+			return nil
 		}
 	}
 
-	if len(errs) > 0 {
-		return errors.Join(errs...)
+	return m.writeTag(image, src, dst, existing, img, func() error {
+		if archive != nil {
+			return archive.write(ref, src, img)
+		}
+		return remote.Push(dstRef, img, o.Remote...)
+	})
+}
+
+// immutableTag returns true if the destination tag exists and must not be overwritten,
+// existing is the digest of the destination tag, empty if it does not exist.
+func (m *mirror) immutableTag(image apiv1.ImageMirror, src, dst, existing string) bool {
+	if existing == "" || image.MutableTags != apiv1.MutableTagsNever {
+		return false
 	}
+	m.log.Info("image already exists and tags are immutable, skip copy", "image", dst)
+	m.dryRun(Action{Operation: OperationSkip, Source: src, Destination: dst, Digest: existing})
+	m.metrics.skippedImage(image.Source)
+	return true
+}
+
+// writeTag writes the image to the destination tag with write unless the tag already has the same digest,
+// existing is the digest of the destination tag, empty if it does not exist.
+func (m *mirror) writeTag(image apiv1.ImageMirror, src, dst, existing string, img remote.Taggable, write func() error) error {
+	if existing != "" && image.MutableTags != apiv1.MutableTagsAlways {
+		digest, err := taggableDigest(img)
+		if err != nil {
+			m.log.Error("unable to compute image digest", "image", src, "error", err)
+			return err
+		}
+		if digest.String() == existing {
+			m.unchangedTag(image, src, dst, existing)
+			return nil
+		}
+		m.log.Info("image has changed", "image", dst, "digest", existing, "source digest", digest.String())
+	}
+
+	if m.dryRun(Action{Operation: OperationCopy, Source: src, Destination: dst}) {
+		m.log.Info("dry-run, skip copy image", "source", src, "destination", dst)
+		return nil
+	}
+	m.log.Info("copy image", "source", src, "destination", dst)
+	err := m.withRetry("copy_image", src, write)
+	if err != nil {
+		m.log.Error("unable to copy", "source", src, "dst", dst, "error", err)
+		return err
+	}
+	m.metrics.copiedImage(image.Source)
 	return nil
 }
+
+// unchangedTag skips the copy of a destination tag which already has the digest of the source
+func (m *mirror) unchangedTag(image apiv1.ImageMirror, src, dst, existing string) {
+	m.log.Info("image is unchanged, skip copy", "image", dst, "digest", existing)
+	m.dryRun(Action{Operation: OperationSkip, Source: src, Destination: dst, Digest: existing})
+	m.metrics.skippedImage(image.Source)
+}
+
+// taggableDigest computes the digest of the manifest which is pushed to the destination,
+// it differs from the source digest if platforms are filtered or a schema 1 image is converted.
+func taggableDigest(t remote.Taggable) (v1.Hash, error) {
+	raw, err := t.RawManifest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(raw))
+	return digest, err
+}
@@ -3,17 +3,28 @@ package container_test
 import (
 	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/foomo/htpasswd"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
 	"github.com/metal-stack/oci-mirror/pkg/container"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
@@ -28,23 +39,8 @@ func TestMirror(t *testing.T) {
 	require.NoError(t, err)
 	dstRegistry := fmt.Sprintf("%s:%d", dstip, dstport)
 
-	f, err := os.CreateTemp("", "htpasswd")
-	require.NoError(t, err)
-	defer func() {
-		_ = os.Remove(f.Name())
-	}()
-
-	err = htpasswd.SetPassword(f.Name(), "user", "secret", htpasswd.HashBCrypt)
-	require.NoError(t, err)
-
-	env := map[string]string{
-		"REGISTRY_AUTH":                "htpasswd",
-		"REGISTRY_AUTH_HTPASSWD_REALM": "registry-login",
-		"REGISTRY_AUTH_HTPASSWD_PATH":  "/htpasswd",
-	}
-	authtip, authport, err := startRegistry(env, new(f.Name()), new("/htpasswd"))
+	authRegistry, err := startAuthRegistry("user", "secret")
 	require.NoError(t, err)
-	authRegistry := fmt.Sprintf("%s:%d", authtip, authport)
 
 	srcAlpine := fmt.Sprintf("%s/library/alpine", srcRegistry)
 	dstAlpine := fmt.Sprintf("%s/library/alpine", dstRegistry)
@@ -64,6 +60,11 @@ func TestMirror(t *testing.T) {
 
 	dstAuthFoo := fmt.Sprintf("%s/library/foo", authRegistry)
 
+	srcNginx := fmt.Sprintf("%s/library/nginx", srcRegistry)
+	dstNginx := fmt.Sprintf("%s/library/nginx", dstRegistry)
+	err = createImage(srcNginx, "1.19.0-debian", "1.20.1-debian", "1.21.0-debian", "1.21.0-alpine", "1.25.0-alpine", "2.0.0-perl")
+	require.NoError(t, err)
+
 	config := apiv1.Config{
 		Registries: map[string]apiv1.Registry{
 			authRegistry: {
@@ -106,6 +107,14 @@ func TestMirror(t *testing.T) {
 					Last: new(int64(2)),
 				},
 			},
+			{
+				Source:      srcNginx,
+				Destination: dstNginx,
+				Match: apiv1.Match{
+					Regex: new(`^1\.2[0-9]\..*-debian$`),
+					Glob:  new("1.25.*-alpine"),
+				},
+			},
 		},
 	}
 
@@ -129,6 +138,583 @@ func TestMirror(t *testing.T) {
 	tags, err = crane.ListTags(dstAuthFoo, crane.WithAuth(&authn.Basic{Username: "user", Password: "secret"}))
 	require.NoError(t, err)
 	require.ElementsMatch(t, []string{"1.0.1", "1.0.2"}, tags)
+
+	tags, err = crane.ListTags(dstNginx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.20.1-debian", "1.21.0-debian", "1.25.0-alpine"}, tags)
+}
+
+func TestMirrorAuthenticatedSourceAndDestination(t *testing.T) {
+	srcRegistry, err := startAuthRegistry("pull", "pullsecret")
+	require.NoError(t, err)
+	dstRegistry, err := startAuthRegistry("push", "pushsecret")
+	require.NoError(t, err)
+
+	srcAuth := crane.WithAuth(&authn.Basic{Username: "pull", Password: "pullsecret"})
+	dstAuth := crane.WithAuth(&authn.Basic{Username: "push", Password: "pushsecret"})
+
+	srcFoo := fmt.Sprintf("%s/library/foo", srcRegistry)
+	dstFoo := fmt.Sprintf("%s/library/foo", dstRegistry)
+	err = createImage(srcFoo, "1.0.0", "1.0.1", "1.0.2")
+	require.Error(t, err, "source registry must require authentication")
+	err = createImageWithOptions(srcFoo, []crane.Option{srcAuth}, "1.0.0", "1.0.1", "1.0.2")
+	require.NoError(t, err)
+
+	srcBar := fmt.Sprintf("%s/library/bar", srcRegistry)
+	dstBar := fmt.Sprintf("%s/library/bar", dstRegistry)
+	err = createImageWithOptions(srcBar, []crane.Option{srcAuth}, "2.0.0", "2.1.0")
+	require.NoError(t, err)
+
+	config := apiv1.Config{
+		Registries: map[string]apiv1.Registry{
+			srcRegistry: {
+				Auth: apiv1.RegistryAuth{
+					Username: "pull",
+					Password: "pullsecret",
+				},
+			},
+			dstRegistry: {
+				Auth: apiv1.RegistryAuth{
+					Username: "push",
+					Password: "pushsecret",
+				},
+			},
+		},
+		Images: []apiv1.ImageMirror{
+			{
+				Source:      srcFoo,
+				Destination: dstFoo,
+				Match: apiv1.Match{
+					Tags: []string{"1.0.0", "1.0.2"},
+				},
+			},
+			{
+				Source:      srcBar,
+				Destination: dstBar,
+				Match: apiv1.Match{
+					AllTags: true,
+				},
+			},
+		},
+	}
+
+	m := container.New(slog.Default(), config, nil)
+	err = m.Mirror(context.Background())
+	require.NoError(t, err)
+
+	tags, err := crane.ListTags(dstFoo, dstAuth)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.0.0", "1.0.2"}, tags)
+
+	tags, err = crane.ListTags(dstBar, dstAuth)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"2.0.0", "2.1.0", "latest"}, tags)
+
+	_, err = crane.ListTags(dstFoo, srcAuth)
+	require.Error(t, err, "pull credentials must not be valid for the destination")
+}
+
+func TestMirrorAuthFromDockerConfigAndCredentialHelper(t *testing.T) {
+	srcRegistry, err := startAuthRegistry("pull", "pullsecret")
+	require.NoError(t, err)
+	dstRegistry, err := startAuthRegistry("push", "pushsecret")
+	require.NoError(t, err)
+
+	srcFoo := fmt.Sprintf("%s/library/foo", srcRegistry)
+	dstFoo := fmt.Sprintf("%s/library/foo", dstRegistry)
+	err = createImageWithOptions(srcFoo, []crane.Option{crane.WithAuth(&authn.Basic{Username: "pull", Password: "pullsecret"})}, "1.0.0", "1.0.1")
+	require.NoError(t, err)
+
+	// the pull credentials are read from a docker config.json
+	dir := t.TempDir()
+	dockerConfig := filepath.Join(dir, "config.json")
+	auth := base64.StdEncoding.EncodeToString([]byte("pull:pullsecret"))
+	err = os.WriteFile(dockerConfig, fmt.Appendf(nil, `{"auths":{%q:{"auth":%q}}}`, srcRegistry, auth), 0600)
+	require.NoError(t, err)
+
+	// the push credentials are returned by a credential helper in the PATH
+	helper := fmt.Sprintf(`#!/bin/sh
+read server
+if [ "$1" = "get" ] && [ "$server" = %q ]; then
+	echo '{"ServerURL":"%s","Username":"push","Secret":"pushsecret"}'
+	exit 0
+fi
+echo "credentials not found in native keychain"
+exit 1
+`, dstRegistry, dstRegistry)
+	err = os.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(helper), 0700)
+	require.NoError(t, err)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	config := apiv1.Config{
+		Registries: map[string]apiv1.Registry{
+			srcRegistry: {Auth: apiv1.RegistryAuth{DockerConfig: dockerConfig}},
+			dstRegistry: {Auth: apiv1.RegistryAuth{CredentialHelper: "test"}},
+		},
+		Images: []apiv1.ImageMirror{
+			{Source: srcFoo, Destination: dstFoo, Match: apiv1.Match{AllTags: true}},
+		},
+	}
+	require.NoError(t, config.Validate())
+
+	m := container.New(slog.Default(), config, nil)
+	err = m.Mirror(context.Background())
+	require.NoError(t, err)
+
+	tags, err := crane.ListTags(dstFoo, crane.WithAuth(&authn.Basic{Username: "push", Password: "pushsecret"}))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.0.0", "1.0.1", "latest"}, tags)
+}
+
+func TestMirrorConcurrent(t *testing.T) {
+	srcip, srcport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	srcRegistry := fmt.Sprintf("%s:%d", srcip, srcport)
+
+	dstip, dstport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	dstRegistry := fmt.Sprintf("%s:%d", dstip, dstport)
+
+	var (
+		images []apiv1.ImageMirror
+		tags   = []string{"1.0.0", "1.1.0", "1.2.0", "1.3.0", "1.4.0", "1.5.0"}
+	)
+	for _, image := range []string{"alpine", "busybox", "foo", "bar"} {
+		src := fmt.Sprintf("%s/library/%s", srcRegistry, image)
+		err = createImage(src, tags...)
+		require.NoError(t, err)
+		images = append(images, apiv1.ImageMirror{
+			Source:      src,
+			Destination: fmt.Sprintf("%s/library/%s", dstRegistry, image),
+			Match: apiv1.Match{
+				Semver: new(">= 1.1"),
+			},
+		})
+	}
+
+	config := apiv1.Config{
+		Registries: map[string]apiv1.Registry{
+			dstRegistry: {
+				Concurrency: 2,
+			},
+		},
+		Images: images,
+	}
+
+	reg := prometheus.NewRegistry()
+	m := container.New(slog.Default(), config, nil)
+	m.SetConcurrency(4)
+	m.SetMetrics(container.NewMetrics(reg))
+	err = m.Mirror(context.Background())
+	require.NoError(t, err)
+
+	for _, image := range images {
+		tags, err := crane.ListTags(image.Destination)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"1.1.0", "1.2.0", "1.3.0", "1.4.0", "1.5.0"}, tags)
+	}
+
+	require.Equal(t, float64(20), sumMetric(t, reg, "oci_mirror_copied_total"))
+	require.Equal(t, float64(0), sumMetric(t, reg, "oci_mirror_skipped_total"))
+	require.Positive(t, sumMetric(t, reg, "oci_mirror_transferred_bytes_total"))
+
+	err = m.Mirror(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, float64(20), sumMetric(t, reg, "oci_mirror_copied_total"))
+	require.Equal(t, float64(20), sumMetric(t, reg, "oci_mirror_skipped_total"))
+	require.Equal(t, float64(0), sumMetric(t, reg, "oci_mirror_failed_total"))
+}
+
+// sumMetric returns the sum of all series of a counter or gauge
+func sumMetric(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	var sum float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			sum += metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+		}
+	}
+	return sum
+}
+
+func TestMirrorDryRun(t *testing.T) {
+	srcip, srcport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	srcRegistry := fmt.Sprintf("%s:%d", srcip, srcport)
+
+	dstip, dstport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	dstRegistry := fmt.Sprintf("%s:%d", dstip, dstport)
+
+	srcFoo := fmt.Sprintf("%s/library/foo", srcRegistry)
+	dstFoo := fmt.Sprintf("%s/library/foo", dstRegistry)
+	err = createImage(srcFoo, "1.0.0", "1.0.1")
+	require.NoError(t, err)
+	err = crane.Copy(srcFoo+":1.0.0", dstFoo+":1.0.0")
+	require.NoError(t, err)
+	digest, err := crane.Digest(dstFoo + ":1.0.0")
+	require.NoError(t, err)
+
+	srcBar := fmt.Sprintf("%s/library/bar", srcRegistry)
+	dstBar := fmt.Sprintf("%s/library/bar", dstRegistry)
+	err = createImage(srcBar, "2.0.0")
+	require.NoError(t, err)
+
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source:      srcFoo,
+				Destination: dstFoo,
+				Match: apiv1.Match{
+					Semver: new(">= 1.0"),
+				},
+			},
+			{
+				Source:      srcBar,
+				Destination: dstBar,
+				Match: apiv1.Match{
+					AllTags: true,
+				},
+			},
+		},
+	}
+
+	m := container.New(slog.Default(), config, nil)
+	m.SetDryRun(true)
+	err = m.Mirror(context.Background())
+	require.NoError(t, err)
+
+	require.Equal(t, []container.Action{
+		{Operation: container.OperationCopy, Source: srcBar + ":2.0.0", Destination: dstBar + ":2.0.0"},
+		{Operation: container.OperationCopy, Source: srcBar + ":latest", Destination: dstBar + ":latest"},
+		{Operation: container.OperationSkip, Source: srcFoo + ":1.0.0", Destination: dstFoo + ":1.0.0", Digest: digest},
+		{Operation: container.OperationCopy, Source: srcFoo + ":1.0.1", Destination: dstFoo + ":1.0.1"},
+	}, m.Plan())
+
+	tags, err := crane.ListTags(dstFoo)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.0.0"}, tags)
+
+	_, err = crane.ListTags(dstBar)
+	require.Error(t, err)
+}
+
+func TestMirrorMutableTags(t *testing.T) {
+	srcip, srcport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	srcRegistry := fmt.Sprintf("%s:%d", srcip, srcport)
+
+	dstip, dstport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	dstRegistry := fmt.Sprintf("%s:%d", dstip, dstport)
+
+	srcFoo := fmt.Sprintf("%s/library/foo", srcRegistry)
+	err = createImage(srcFoo, "1.0", "stable")
+	require.NoError(t, err)
+
+	var images []apiv1.ImageMirror
+	for _, policy := range []apiv1.MutableTagsPolicy{apiv1.MutableTagsAlways, apiv1.MutableTagsOnChange, apiv1.MutableTagsNever} {
+		images = append(images, apiv1.ImageMirror{
+			Source:      srcFoo,
+			Destination: fmt.Sprintf("%s/library/foo-%s", dstRegistry, policy),
+			Match: apiv1.Match{
+				Tags: []string{"1.0", "stable"},
+			},
+			MutableTags: policy,
+		})
+	}
+	config := apiv1.Config{Images: images}
+
+	m := container.New(slog.Default(), config, nil)
+	err = m.Mirror(context.Background())
+	require.NoError(t, err)
+
+	oldStable, err := crane.Digest(srcFoo + ":stable")
+	require.NoError(t, err)
+
+	// move the stable tag to a new image
+	err = createImage(srcFoo, "stable")
+	require.NoError(t, err)
+	newStable, err := crane.Digest(srcFoo + ":stable")
+	require.NoError(t, err)
+	require.NotEqual(t, oldStable, newStable)
+
+	reg := prometheus.NewRegistry()
+	m = container.New(slog.Default(), config, nil)
+	m.SetMetrics(container.NewMetrics(reg))
+	err = m.Mirror(context.Background())
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		policy apiv1.MutableTagsPolicy
+		want   string
+	}{
+		{policy: apiv1.MutableTagsAlways, want: newStable},
+		{policy: apiv1.MutableTagsOnChange, want: newStable},
+		{policy: apiv1.MutableTagsNever, want: oldStable},
+	} {
+		digest, err := crane.Digest(fmt.Sprintf("%s/library/foo-%s:stable", dstRegistry, tt.policy))
+		require.NoError(t, err)
+		require.Equal(t, tt.want, digest, "policy %s", tt.policy)
+	}
+
+	// always copies both tags, on_change only the moved stable tag, never none of them
+	require.Equal(t, float64(3), sumMetric(t, reg, "oci_mirror_copied_total"))
+	require.Equal(t, float64(3), sumMetric(t, reg, "oci_mirror_skipped_total"))
+}
+
+func TestMirrorPlatforms(t *testing.T) {
+	srcip, srcport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	srcRegistry := fmt.Sprintf("%s:%d", srcip, srcport)
+
+	dstip, dstport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	dstRegistry := fmt.Sprintf("%s:%d", dstip, dstport)
+
+	srcMulti := fmt.Sprintf("%s/library/multi", srcRegistry)
+	dstMulti := fmt.Sprintf("%s/library/multi", dstRegistry)
+	err = createIndex(srcMulti, []string{"linux/amd64", "linux/arm64/v8", "linux/s390x"}, "1.0.0", "1.1.0")
+	require.NoError(t, err)
+
+	srcRiscv := fmt.Sprintf("%s/library/riscv", srcRegistry)
+	dstRiscv := fmt.Sprintf("%s/library/riscv", dstRegistry)
+	err = createIndex(srcRiscv, []string{"linux/riscv64"}, "1.0.0")
+	require.NoError(t, err)
+
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source:      srcMulti,
+				Destination: dstMulti,
+				Match: apiv1.Match{
+					AllTags: true,
+				},
+				Platforms: []string{"linux/amd64", "linux/arm64"},
+			},
+			{
+				Source:      srcRiscv,
+				Destination: dstRiscv,
+				Match: apiv1.Match{
+					Tags: []string{"1.0.0"},
+				},
+				Platforms: []string{"linux/amd64"},
+			},
+		},
+	}
+
+	m := container.New(slog.Default(), config, nil)
+	err = m.Mirror(context.Background())
+	require.NoError(t, err)
+
+	tags, err := crane.ListTags(dstMulti)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.0.0", "1.1.0", "latest"}, tags)
+
+	for _, tag := range tags {
+		ref, err := name.ParseReference(dstMulti + ":" + tag)
+		require.NoError(t, err)
+		idx, err := remote.Index(ref)
+		require.NoError(t, err)
+		manifest, err := idx.IndexManifest()
+		require.NoError(t, err)
+
+		var platforms []string
+		for _, desc := range manifest.Manifests {
+			platforms = append(platforms, desc.Platform.String())
+			// the referenced images must be pushed as well
+			img, err := idx.Image(desc.Digest)
+			require.NoError(t, err)
+			_, err = img.ConfigFile()
+			require.NoError(t, err)
+		}
+		require.ElementsMatch(t, []string{"linux/amd64", "linux/arm64/v8"}, platforms)
+	}
+
+	_, err = crane.ListTags(dstRiscv)
+	require.Error(t, err, "image without matching platform must not be mirrored")
+}
+
+func TestMirrorMultipleDestinations(t *testing.T) {
+	srcip, srcport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	srcRegistry := fmt.Sprintf("%s:%d", srcip, srcport)
+
+	eastip, eastport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	eastRegistry := fmt.Sprintf("%s:%d", eastip, eastport)
+
+	westip, westport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	westRegistry := fmt.Sprintf("%s:%d", westip, westport)
+
+	srcMulti := fmt.Sprintf("%s/library/multi", srcRegistry)
+	dstEast := fmt.Sprintf("%s/library/multi", eastRegistry)
+	dstWest := fmt.Sprintf("%s/library/multi", westRegistry)
+	err = createIndex(srcMulti, []string{"linux/amd64", "linux/arm64/v8"}, "1.0.0", "1.1.0", "1.2.0")
+	require.NoError(t, err)
+
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source: srcMulti,
+				Match: apiv1.Match{
+					Semver: new(">= 1.1"),
+				},
+				Destinations: []apiv1.Destination{
+					{
+						Destination: dstEast,
+					},
+					{
+						Destination: "http://" + dstWest,
+						Match: &apiv1.Match{
+							Tags: []string{"1.0.0", "1.2.0"},
+						},
+						Platforms: []string{"linux/amd64"},
+					},
+				},
+			},
+		},
+	}
+	require.NoError(t, config.Validate())
+
+	reg := prometheus.NewRegistry()
+	m := container.New(slog.Default(), config, nil)
+	m.SetMetrics(container.NewMetrics(reg))
+	err = m.Mirror(context.Background())
+	require.NoError(t, err)
+
+	tags, err := crane.ListTags(dstEast)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.1.0", "1.2.0"}, tags)
+
+	tags, err = crane.ListTags(dstWest)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.0.0", "1.2.0"}, tags)
+
+	// the platform override only applies to the west destination
+	srcDigest, err := crane.Digest(srcMulti + ":1.2.0")
+	require.NoError(t, err)
+	eastDigest, err := crane.Digest(dstEast + ":1.2.0")
+	require.NoError(t, err)
+	require.Equal(t, srcDigest, eastDigest)
+
+	idx, err := remote.Index(mustParseReference(t, dstWest+":1.2.0"))
+	require.NoError(t, err)
+	manifest, err := idx.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Manifests, 1)
+	require.Equal(t, "amd64", manifest.Manifests[0].Platform.Architecture)
+
+	// every source manifest is read once, regardless of the number of destinations
+	require.Equal(t, float64(3), sumMetric(t, reg, "oci_mirror_manifests_total"))
+	require.Equal(t, float64(4), sumMetric(t, reg, "oci_mirror_copied_total"))
+}
+
+func TestMirrorManifestKinds(t *testing.T) {
+	srcip, srcport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	srcRegistry := fmt.Sprintf("%s:%d", srcip, srcport)
+
+	dstip, dstport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	dstRegistry := fmt.Sprintf("%s:%d", dstip, dstport)
+
+	srcOCIIndex := fmt.Sprintf("%s/library/oci-index", srcRegistry)
+	err = createIndex(srcOCIIndex, []string{"linux/amd64", "linux/arm64"}, "1.0.0")
+	require.NoError(t, err)
+
+	srcDockerList := fmt.Sprintf("%s/library/docker-list", srcRegistry)
+	idx, err := random.Index(128, 1, 2)
+	require.NoError(t, err)
+	err = remote.WriteIndex(mustParseReference(t, srcDockerList+":1.0.0"), mutate.IndexMediaType(idx, types.DockerManifestList))
+	require.NoError(t, err)
+
+	srcChart := fmt.Sprintf("%s/charts/foo", srcRegistry)
+	chartLayer, err := random.Layer(128, types.MediaType("application/vnd.cncf.helm.chart.content.v1.tar+gzip"))
+	require.NoError(t, err)
+	chart, err := mutate.AppendLayers(mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.MediaType("application/vnd.cncf.helm.config.v1+json")), chartLayer)
+	require.NoError(t, err)
+	err = remote.Write(mustParseReference(t, srcChart+":1.0.0"), chart)
+	require.NoError(t, err)
+
+	var images []apiv1.ImageMirror
+	for _, src := range []string{srcOCIIndex, srcDockerList, srcChart} {
+		images = append(images, apiv1.ImageMirror{
+			Source:      src,
+			Destination: strings.Replace(src, srcRegistry, dstRegistry, 1),
+			Match: apiv1.Match{
+				Tags: []string{"1.0.0"},
+			},
+		})
+	}
+
+	reg := prometheus.NewRegistry()
+	m := container.New(slog.Default(), apiv1.Config{Images: images}, nil)
+	m.SetMetrics(container.NewMetrics(reg))
+	err = m.Mirror(context.Background())
+	require.NoError(t, err)
+
+	for _, image := range images {
+		srcDesc, err := remote.Get(mustParseReference(t, image.Source+":1.0.0"))
+		require.NoError(t, err)
+		dstDesc, err := remote.Get(mustParseReference(t, image.Destination+":1.0.0"))
+		require.NoError(t, err)
+		require.Equal(t, srcDesc.MediaType, dstDesc.MediaType)
+		require.Equal(t, srcDesc.Digest, dstDesc.Digest)
+	}
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	kinds := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "oci_mirror_manifests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			kinds[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+		}
+	}
+	require.Equal(t, map[string]float64{"index": 2, "artifact": 1}, kinds)
+}
+
+func mustParseReference(t *testing.T, ref string) name.Reference {
+	r, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	return r
+}
+
+// startAuthRegistry starts a registry which is protected by htpasswd with the given credentials
+func startAuthRegistry(username, password string) (string, error) {
+	f, err := os.CreateTemp("", "htpasswd")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	err = htpasswd.SetPassword(f.Name(), username, password, htpasswd.HashBCrypt)
+	if err != nil {
+		return "", err
+	}
+
+	env := map[string]string{
+		"REGISTRY_AUTH":                "htpasswd",
+		"REGISTRY_AUTH_HTPASSWD_REALM": "registry-login",
+		"REGISTRY_AUTH_HTPASSWD_PATH":  "/htpasswd",
+		// allows purge tests against authenticated registries
+		"REGISTRY_STORAGE_DELETE_ENABLED": "true",
+	}
+	ip, port, err := startRegistry(env, new(f.Name()), new("/htpasswd"))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", ip, port), nil
 }
 
 func startRegistry(env map[string]string, src, dst *string) (string, uint16, error) {
@@ -174,6 +760,10 @@ func startRegistry(env map[string]string, src, dst *string) (string, uint16, err
 }
 
 func createImage(name string, tags ...string) error {
+	return createImageWithOptions(name, nil, tags...)
+}
+
+func createImageWithOptions(name string, opts []crane.Option, tags ...string) error {
 	// ensure every image has distinct content
 	buf := make([]byte, 128)
 	_, err := rand.Read(buf)
@@ -184,12 +774,46 @@ func createImage(name string, tags ...string) error {
 	if err != nil {
 		return err
 	}
-	err = crane.Push(img, name)
+	err = crane.Push(img, name, opts...)
 	if err != nil {
 		return err
 	}
 	for _, tag := range tags {
-		err := crane.Push(img, name+":"+tag)
+		err := crane.Push(img, name+":"+tag, opts...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createIndex pushes a multi-platform image index with one distinct image per platform
+func createIndex(ref string, platforms []string, tags ...string) error {
+	var idx v1.ImageIndex = empty.Index
+	for _, platform := range platforms {
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return err
+		}
+		img, err := random.Image(128, 1)
+		if err != nil {
+			return err
+		}
+		img, err = mutate.ConfigFile(img, &v1.ConfigFile{OS: p.OS, Architecture: p.Architecture, Variant: p.Variant})
+		if err != nil {
+			return err
+		}
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: p},
+		})
+	}
+	for _, tag := range append([]string{"latest"}, tags...) {
+		dst, err := name.ParseReference(ref + ":" + tag)
+		if err != nil {
+			return err
+		}
+		err = remote.WriteIndex(dst, idx)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,78 @@
+package container
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// Operation is the kind of a planned action
+type Operation string
+
+const (
+	// OperationCopy copies a source image to the destination
+	OperationCopy = Operation("copy")
+	// OperationSkip is a source image which is unchanged or must not be overwritten in the destination
+	OperationSkip = Operation("skip")
+	// OperationDelete deletes a digest in the destination
+	OperationDelete = Operation("delete")
+	// OperationKeep is a digest which is not deleted because a kept tag references it
+	OperationKeep = Operation("keep")
+	// OperationReport is an unknown tag outside of the purge-unknown scope, it is reported but never deleted
+	OperationReport = Operation("report")
+)
+
+// Action is a single write operation which is performed or would be performed in dry-run mode
+type Action struct {
+	Operation   Operation `json:"operation"`
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination"`
+	Digest      string    `json:"digest,omitempty"`
+}
+
+// plan collects all actions of a dry-run
+type plan struct {
+	mu      sync.Mutex
+	actions []Action
+}
+
+func (p *plan) add(action Action) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.actions = append(p.actions, action)
+}
+
+// SetDryRun enables the dry-run mode, no writes are performed, instead all actions are recorded in the plan
+func (m *mirror) SetDryRun(dryRun bool) {
+	m.plan = nil
+	if dryRun {
+		m.plan = &plan{}
+	}
+}
+
+// Plan returns the actions recorded in dry-run mode sorted by destination
+func (m *mirror) Plan() []Action {
+	if m.plan == nil {
+		return nil
+	}
+	m.plan.mu.Lock()
+	defer m.plan.mu.Unlock()
+	actions := slices.Clone(m.plan.actions)
+	slices.SortStableFunc(actions, func(a, b Action) int {
+		return cmp.Or(
+			cmp.Compare(a.Destination, b.Destination),
+			cmp.Compare(a.Source, b.Source),
+			cmp.Compare(a.Operation, b.Operation),
+		)
+	})
+	return actions
+}
+
+// dryRun records the action if the dry-run mode is enabled and reports if the write must be omitted
+func (m *mirror) dryRun(action Action) bool {
+	if m.plan == nil {
+		return false
+	}
+	m.plan.add(action)
+	return true
+}
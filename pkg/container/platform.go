@@ -0,0 +1,108 @@
+package container
+
+import (
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func parsePlatforms(platforms []string) ([]v1.Platform, error) {
+	var result []v1.Platform
+	for _, platform := range platforms {
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse platform %q %w", platform, err)
+		}
+		result = append(result, *p)
+	}
+	return result, nil
+}
+
+// platformMatches returns true if the platform satisfies one of the given platforms,
+// e.g. linux/arm64/v8 satisfies linux/arm64
+func platformMatches(platform *v1.Platform, platforms []v1.Platform) bool {
+	if platform == nil {
+		return false
+	}
+	for _, p := range platforms {
+		if platform.Satisfies(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterPlatforms returns the index reduced to the manifests which match one of the platforms,
+// and the number of remaining manifests
+func filterPlatforms(idx v1.ImageIndex, platforms []v1.Platform) (v1.ImageIndex, int, error) {
+	filtered := mutate.RemoveManifests(idx, func(desc v1.Descriptor) bool {
+		return !platformMatches(desc.Platform, platforms)
+	})
+	manifest, err := filtered.IndexManifest()
+	if err != nil {
+		return nil, 0, err
+	}
+	return filtered, len(manifest.Manifests), nil
+}
+
+// platformImage returns the image or the reduced image index of the descriptor which only contains the given platforms,
+// nil is returned if no platform matches
+func (m *mirror) platformImage(src string, desc *remote.Descriptor, platforms []string) (remote.Taggable, error) {
+	var (
+		t   remote.Taggable
+		err error
+	)
+	switch {
+	case desc.MediaType.IsIndex():
+		t, err = desc.ImageIndex()
+	case desc.MediaType.IsImage():
+		t, err = desc.Image()
+	default:
+		err = fmt.Errorf("unable to filter platforms of %q with media type %q", src, desc.MediaType)
+	}
+	if err != nil {
+		m.log.Error("unable to filter platforms", "image", src, "error", err)
+		return nil, err
+	}
+	return m.reducePlatforms(src, t, platforms)
+}
+
+// reducePlatforms returns the image or the image index reduced to the manifests of the given platforms,
+// nil is returned if no platform matches
+func (m *mirror) reducePlatforms(src string, t remote.Taggable, platforms []string) (remote.Taggable, error) {
+	parsed, err := parsePlatforms(platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		reduced remote.Taggable
+		count   int
+	)
+	switch t := t.(type) {
+	case v1.ImageIndex:
+		reduced, count, err = filterPlatforms(t, parsed)
+		if count > 0 {
+			m.log.Debug("reduced image index to platforms", "image", src, "manifests", count)
+		}
+	case v1.Image:
+		var cfg *v1.ConfigFile
+		cfg, err = t.ConfigFile()
+		if err == nil && platformMatches(cfg.Platform(), parsed) {
+			reduced, count = t, 1
+		}
+	default:
+		err = fmt.Errorf("unable to filter platforms of %q of type %T", src, t)
+	}
+	if err != nil {
+		m.log.Error("unable to filter platforms", "image", src, "error", err)
+		return nil, err
+	}
+	if count == 0 {
+		m.log.Warn("image does not contain any of the platforms, ignoring", "image", src, "platforms", platforms)
+		return nil, nil
+	}
+	return reduced, nil
+}
@@ -0,0 +1,73 @@
+package container
+
+import (
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterPlatforms(t *testing.T) {
+	var idx v1.ImageIndex = empty.Index
+	for _, platform := range []string{"linux/amd64", "linux/arm64/v8", "linux/arm/v7", "windows/amd64"} {
+		img, err := random.Image(128, 1)
+		require.NoError(t, err)
+		p, err := v1.ParsePlatform(platform)
+		require.NoError(t, err)
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: p},
+		})
+	}
+	// attestation manifests have no platform
+	img, err := random.Image(128, 1)
+	require.NoError(t, err)
+	idx = mutate.AppendManifests(idx, mutate.IndexAddendum{Add: img})
+
+	tests := []struct {
+		name      string
+		platforms []string
+		want      []string
+	}{
+		{
+			name:      "single platform",
+			platforms: []string{"linux/amd64"},
+			want:      []string{"linux/amd64"},
+		},
+		{
+			name:      "platform without variant matches all variants",
+			platforms: []string{"linux/arm64", "linux/arm"},
+			want:      []string{"linux/arm64/v8", "linux/arm/v7"},
+		},
+		{
+			name:      "variant must match",
+			platforms: []string{"linux/arm/v6"},
+		},
+		{
+			name:      "multiple platforms",
+			platforms: []string{"linux/amd64", "windows/amd64"},
+			want:      []string{"linux/amd64", "windows/amd64"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			platforms, err := parsePlatforms(tt.platforms)
+			require.NoError(t, err)
+
+			filtered, count, err := filterPlatforms(idx, platforms)
+			require.NoError(t, err)
+			require.Equal(t, len(tt.want), count)
+
+			manifest, err := filtered.IndexManifest()
+			require.NoError(t, err)
+			var got []string
+			for _, desc := range manifest.Manifests {
+				got = append(got, desc.Platform.String())
+			}
+			require.ElementsMatch(t, tt.want, got)
+		})
+	}
+}
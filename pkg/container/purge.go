@@ -4,80 +4,64 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path"
 	"slices"
 	"strings"
+	"sync"
 
 	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
 )
 
 func (m *mirror) Purge(ctx context.Context) error {
 	var (
 		errs []error
 	)
-	for _, image := range m.config.Images {
-		if image.Purge == nil {
-			continue
-		}
-
-		var (
-			err         error
-			opts        []crane.Option
-			tagsToPurge []string
-		)
-
-		opts, err = m.ensureAuthOption(&image)
-		if err != nil {
-			m.log.Warn("unable detect auth, continue unauthenticated", "error", err)
-		}
-		opts = append(opts, crane.WithContext(ctx))
-
-		tags, err := crane.ListTags(image.Destination, opts...)
-		if err != nil {
-			m.log.Error("unable to list tags of", "image", image.Source, "error", err)
-			errs = append(errs, err)
-			continue
-		}
-
-		for _, tag := range tags {
-			// never purge latest
-			if tag == "latest" {
+	for _, entry := range m.config.Images {
+		var sourceTags func() ([]string, error)
+		for _, image := range entry.Mirrors() {
+			if image.Purge == nil {
 				continue
 			}
-			dst := image.Destination + ":" + tag
 
-			if slices.Contains(image.Purge.Tags, tag) {
-				tagsToPurge = append(tagsToPurge, dst)
+			opts, err := m.ensureAuthOption(&image)
+			if err != nil {
+				m.log.Warn("unable detect auth, continue unauthenticated", "error", err)
 			}
+			opts = append(opts, crane.WithContext(ctx))
 
-			if image.Purge.Semver != nil {
-				ok, err := m.tagMatches(image.Destination, tag, *image.Purge.Semver)
-				if err != nil {
-					errs = append(errs, err)
-					continue
-				}
-				if ok {
-					tagsToPurge = append(tagsToPurge, dst)
-				}
+			// the source tags are listed once for all destinations
+			if sourceTags == nil {
+				sourceTags = sync.OnceValues(func() ([]string, error) {
+					return m.listTags(entry.Source, opts)
+				})
 			}
 
-			if !image.Purge.NoMatch {
+			candidates, err := m.purgeCandidates(image, sourceTags, opts)
+			if err != nil {
+				errs = append(errs, err)
 				continue
 			}
 
-			tagsToCopy, err := m.getTagsToCopy(image, opts)
+			purge, keep, err := m.planPurge(image, candidates)
 			if err != nil {
 				errs = append(errs, err)
 				continue
 			}
-			if !slices.Contains(tagsToCopy.destinationTags(), dst) {
-				tagsToPurge = append(tagsToPurge, dst)
-			}
 
-		}
+			var tagsToPurge, kept []string
+			for _, tag := range purge {
+				tagsToPurge = append(tagsToPurge, image.Destination+":"+tag)
+			}
+			for _, tag := range keep {
+				kept = append(kept, image.Destination+":"+tag)
+			}
 
-		err = m.purge(image.Destination, tagsToPurge, opts)
-		if err != nil {
-			errs = append(errs, err)
+			err = m.purge(image.Destination, tagsToPurge, kept, opts)
+			if err != nil {
+				errs = append(errs, err)
+			}
 		}
 	}
 
@@ -87,73 +71,140 @@ func (m *mirror) Purge(ctx context.Context) error {
 	return nil
 }
 
+// PurgeUnknown purges all tags in the destination registries which are not mirrored by any image,
+// repositories of images which mirror all tags are kept as a whole.
 func (m *mirror) PurgeUnknown(ctx context.Context) error {
 	var (
-		existing  []string
-		allowed   []string
-		purgeable []string
+		errs []error
+		// known repositories are mirrored with all tags
+		known = make(map[string]bool)
+		// allowed tags are mirrored by an image
+		allowed = make(map[string]bool)
 	)
-	// FIXME crane opts
 	registries, err := m.affectedRegistries(destinationRegistry)
 	if err != nil {
 		return err
 	}
 
+	// all mirrored tags must be known before anything is purged
+	for _, entry := range m.config.Images {
+		var sourceTags func() ([]string, error)
+		for _, image := range entry.Mirrors() {
+			if _, _, ok := apiv1.ParseArchive(image.Destination); ok {
+				continue
+			}
+			opts, err := m.ensureAuthOption(&image)
+			if err != nil {
+				m.log.Warn("unable detect auth, continue unauthenticated", "error", err)
+			}
+			opts = append(opts, crane.WithContext(ctx))
+
+			dst, err := name.ParseReference(image.Destination)
+			if err != nil {
+				return err
+			}
+			if image.Match.AllTags {
+				known[dst.Context().Name()] = true
+				continue
+			}
+
+			// the source tags are listed once for all destinations
+			if sourceTags == nil {
+				sourceTags = sync.OnceValues(func() ([]string, error) {
+					return m.listTags(entry.Source, opts)
+				})
+			}
+			srcTags, err := sourceTags()
+			if err != nil {
+				return fmt.Errorf("unable to get tags to copy:%w", err)
+			}
+			tagsToCopy, err := m.selectTags(image, srcTags)
+			if err != nil {
+				return fmt.Errorf("unable to get tags to copy:%w", err)
+			}
+			for _, tag := range tagsToCopy.destinationTags() {
+				ref, err := name.ParseReference(tag)
+				if err != nil {
+					return err
+				}
+				allowed[ref.Name()] = true
+			}
+		}
+	}
+
 	for _, registry := range registries {
-		catalog, err := crane.Catalog(registry)
+		opts := m.registryOptions(ctx, registry)
+		repositories, err := m.catalog(registry, opts)
 		if err != nil {
-			return err
+			m.log.Error("unable to list repositories of", "registry", registry.name, "error", err)
+			errs = append(errs, fmt.Errorf("unable to list repositories of registry:%q error %w", registry.name, err))
+			continue
 		}
-		for _, c := range catalog {
-			image := fmt.Sprintf("%s/%s", registry, c)
 
-			tags, err := crane.ListTags(image)
+		for _, repository := range repositories {
+			image := registry.name + "/" + repository
+			if known[image] {
+				continue
+			}
+
+			tags, err := m.listTags(image, opts)
 			if err != nil {
-				return err
+				errs = append(errs, err)
+				continue
 			}
+
+			var purgeable, kept []string
 			for _, tag := range tags {
+				ref := image + ":" + tag
 				// never purge latest
-				if tag == "latest" {
+				if tag == "latest" || allowed[ref] {
+					kept = append(kept, ref)
+					continue
+				}
+				if reason := m.outOfPurgeScope(image, ref); reason != "" {
+					m.log.Warn("unknown image is not purged", "image", ref, "reason", reason)
+					m.dryRun(Action{Operation: OperationReport, Destination: ref})
+					kept = append(kept, ref)
 					continue
 				}
-				existing = append(existing, image+":"+tag)
+				m.log.Info("purge unknown", "image", ref)
+				purgeable = append(purgeable, ref)
 			}
-		}
-	}
-	for _, image := range m.config.Images {
-		var (
-			err  error
-			opts []crane.Option
-		)
-		opts, err = m.ensureAuthOption(&image)
-		if err != nil {
-			m.log.Warn("unable detect auth, continue unauthenticated", "error", err)
-		}
-		opts = append(opts, crane.WithContext(ctx))
-		// FIXME howto handle match.Alltags
 
-		tagsToCopy, err := m.getTagsToCopy(image, opts)
-		if err != nil {
-			return fmt.Errorf("unable to get tags to copy:%w", err)
+			err = m.purge(image, purgeable, kept, opts)
+			if err != nil {
+				errs = append(errs, err)
+			}
 		}
-		allowed = append(allowed, tagsToCopy.destinationTags()...)
 	}
 
-	for _, image := range existing {
-		if !slices.Contains(allowed, image) {
-			purgeable = append(purgeable, image)
-		}
-	}
+	return errors.Join(errs...)
+}
 
-	for _, tag := range purgeable {
-		m.log.Info("purge unknown", "images", tag)
-		// tag is the whole image refspec, split away the tag to get the image alone
-		lastInd := strings.LastIndex(tag, ":")
-		image := tag[:lastInd]
-		err := m.purge(image, []string{tag}, nil)
-		if err != nil {
-			return err
+// outOfPurgeScope returns why the unknown tag of the repository must not be purged, empty if it may be purged
+func (m *mirror) outOfPurgeScope(repository, ref string) string {
+	scope := m.config.PurgeUnknown
+	if scope == nil {
+		return ""
+	}
+	// prefixes cover whole path segments, r.example.com/team does not cover r.example.com/team-other
+	hasPrefix := func(prefix string) bool {
+		prefix = strings.TrimSuffix(prefix, "/")
+		return repository == prefix || strings.HasPrefix(repository, prefix+"/")
+	}
+	if len(scope.Repositories) > 0 && !slices.ContainsFunc(scope.Repositories, hasPrefix) {
+		return "repository is not part of purge_unknown.repositories"
+	}
+	if slices.ContainsFunc(scope.Protected, hasPrefix) {
+		return "repository is protected by purge_unknown.protected"
+	}
+	for _, exclude := range scope.Exclude {
+		if ok, _ := path.Match(exclude, repository); ok {
+			return "repository is excluded by purge_unknown.exclude"
+		}
+		if ok, _ := path.Match(exclude, ref); ok {
+			return "tag is excluded by purge_unknown.exclude"
 		}
 	}
-	return nil
+	return ""
 }
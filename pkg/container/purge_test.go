@@ -5,8 +5,13 @@ import (
 	"fmt"
 	"log/slog"
 	"testing"
+	"time"
 
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
 	"github.com/metal-stack/oci-mirror/pkg/container"
 	"github.com/stretchr/testify/require"
@@ -25,6 +30,7 @@ func TestPurge(t *testing.T) {
 	dstAlpine := fmt.Sprintf("%s/library/alpine", dstRegistry)
 	dstBusybox := fmt.Sprintf("%s/library/busybox", dstRegistry)
 	dstFoo := fmt.Sprintf("%s/library/foo", dstRegistry)
+	dstNginx := fmt.Sprintf("%s/library/nginx", dstRegistry)
 
 	for _, tag := range []string{"foo", "bar", "3.10", "3.11", "3.12", "3.13", "3.14", "3.15", "3.16", "3.17", "3.18", "3.19"} {
 		err = createImage(dstAlpine, tag)
@@ -38,6 +44,10 @@ func TestPurge(t *testing.T) {
 		err = createImage(dstFoo, tag)
 		require.NoError(t, err)
 	}
+	for _, tag := range []string{"1.25.0", "1.25.0-debug", "1.26.0-rc1", "1.26.0-rc2", "1.26.0"} {
+		err = createImage(dstNginx, tag)
+		require.NoError(t, err)
+	}
 
 	config := apiv1.Config{
 		Images: []apiv1.ImageMirror{
@@ -62,6 +72,17 @@ func TestPurge(t *testing.T) {
 					NoMatch: true,
 				},
 			},
+			{
+				Source:      dstNginx,
+				Destination: "http://" + dstNginx,
+				Match: apiv1.Match{
+					Semver: new(">= 1.25"),
+				},
+				Purge: &apiv1.Purge{
+					Regex: new(`-rc[0-9]+$`),
+					Glob:  new("*-debug"),
+				},
+			},
 		},
 	}
 
@@ -79,6 +100,10 @@ func TestPurge(t *testing.T) {
 	t.Logf("busybox tags:%s", tags)
 	require.NoError(t, err)
 	require.ElementsMatch(t, []string{"1.3", "1.4", "1.5", "1.6", "latest"}, tags)
+
+	tags, err = crane.ListTags(dstNginx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.25.0", "1.26.0", "latest"}, tags)
 }
 
 func TestPurgeUnknown(t *testing.T) {
@@ -149,8 +174,401 @@ func TestPurgeUnknown(t *testing.T) {
 	require.NoError(t, err)
 	require.ElementsMatch(t, []string{"1.3", "1.4", "1.5", "1.6", "latest"}, tags)
 
+	// bar was pushed last and shares its digest with latest, deleting it would delete latest as well
 	tags, err = crane.ListTags(dstFoo)
 	t.Logf("foo tags:%s", tags)
 	require.NoError(t, err)
-	require.Empty(t, tags)
+	require.ElementsMatch(t, []string{"bar", "latest"}, tags)
+}
+
+func TestPurgeUnknownAuthenticated(t *testing.T) {
+	srcip, srcport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	srcRegistry := fmt.Sprintf("%s:%d", srcip, srcport)
+
+	dstRegistry, err := startAuthRegistry("user", "secret")
+	require.NoError(t, err)
+	auth := []crane.Option{crane.WithAuth(&authn.Basic{Username: "user", Password: "secret"})}
+
+	srcFoo := fmt.Sprintf("%s/library/foo", srcRegistry)
+	dstFoo := fmt.Sprintf("%s/library/foo", dstRegistry)
+	srcBar := fmt.Sprintf("%s/library/bar", srcRegistry)
+	dstBar := fmt.Sprintf("%s/library/bar", dstRegistry)
+	dstBaz := fmt.Sprintf("%s/library/baz", dstRegistry)
+
+	err = createImage(srcFoo, "1.0", "1.1", "1.2")
+	require.NoError(t, err)
+	err = createImage(srcBar, "x")
+	require.NoError(t, err)
+	for _, tag := range []string{"1.0", "1.1", "1.2"} {
+		err = createImageWithOptions(dstFoo, auth, tag)
+		require.NoError(t, err)
+	}
+	// tags of repositories which mirror all tags are kept, even if they vanished from the source
+	err = createImageWithOptions(dstBar, auth, "x", "y")
+	require.NoError(t, err)
+	for _, tag := range []string{"0.9", "1.0"} {
+		err = createImageWithOptions(dstBaz, auth, tag)
+		require.NoError(t, err)
+	}
+
+	config := apiv1.Config{
+		Registries: map[string]apiv1.Registry{
+			dstRegistry: {
+				Auth: apiv1.RegistryAuth{
+					Username: "user",
+					Password: "secret",
+				},
+			},
+		},
+		Images: []apiv1.ImageMirror{
+			{
+				Source:      srcFoo,
+				Destination: dstFoo,
+				Match: apiv1.Match{
+					Semver: new(">= 1.1"),
+				},
+			},
+			{
+				Source:      srcBar,
+				Destination: dstBar,
+				Match: apiv1.Match{
+					AllTags: true,
+				},
+			},
+		},
+	}
+
+	m := container.New(slog.Default(), config, nil)
+	err = m.PurgeUnknown(context.Background())
+	require.NoError(t, err)
+
+	tags, err := crane.ListTags(dstFoo, auth...)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.1", "1.2", "latest"}, tags)
+
+	tags, err = crane.ListTags(dstBar, auth...)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"x", "y", "latest"}, tags)
+
+	// 1.0 shares its digest with latest
+	tags, err = crane.ListTags(dstBaz, auth...)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.0", "latest"}, tags)
+}
+
+func TestPurgeUnknownScoped(t *testing.T) {
+	env := map[string]string{
+		"REGISTRY_STORAGE_DELETE_ENABLED": "true",
+	}
+
+	dstip, dstport, err := startRegistry(env, nil, nil)
+	require.NoError(t, err)
+	dstRegistry := fmt.Sprintf("%s:%d", dstip, dstport)
+
+	dstFoo := fmt.Sprintf("%s/mirror/foo", dstRegistry)
+	dstUnknown := fmt.Sprintf("%s/mirror/unknown", dstRegistry)
+	dstProtected := fmt.Sprintf("%s/mirror/protected/bar", dstRegistry)
+	dstCache := fmt.Sprintf("%s/mirror/cache", dstRegistry)
+	dstOther := fmt.Sprintf("%s/other-team/baz", dstRegistry)
+	// shares the prefix of the scope but is a different repository
+	dstSibling := fmt.Sprintf("%s/mirror-other/baz", dstRegistry)
+
+	err = createImage(dstFoo, "1.0", "1.1")
+	require.NoError(t, err)
+	for _, tag := range []string{"1.0", "1.0-keep"} {
+		err = createImage(dstUnknown, tag)
+		require.NoError(t, err)
+	}
+	for _, image := range []string{dstProtected, dstCache, dstOther, dstSibling} {
+		err = createImage(image, "1.0")
+		require.NoError(t, err)
+	}
+
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source:      dstFoo,
+				Destination: "http://" + dstFoo,
+				Match: apiv1.Match{
+					Tags: []string{"1.0", "1.1"},
+				},
+			},
+		},
+		PurgeUnknown: &apiv1.PurgeUnknown{
+			Repositories: []string{dstRegistry + "/mirror"},
+			Protected:    []string{dstRegistry + "/mirror/protected/"},
+			Exclude:      []string{dstRegistry + "/*/cache", dstRegistry + "/mirror/*:*-keep"},
+		},
+	}
+
+	m := container.New(slog.Default(), config, nil)
+	m.SetDryRun(true)
+	err = m.PurgeUnknown(context.Background())
+	require.NoError(t, err)
+
+	var reported []string
+	for _, action := range m.Plan() {
+		if action.Operation == container.OperationReport {
+			reported = append(reported, action.Destination)
+		}
+	}
+	require.ElementsMatch(t, []string{dstUnknown + ":1.0-keep", dstProtected + ":1.0", dstCache + ":1.0", dstOther + ":1.0", dstSibling + ":1.0"}, reported)
+
+	m.SetDryRun(false)
+	err = m.PurgeUnknown(context.Background())
+	require.NoError(t, err)
+
+	tags, err := crane.ListTags(dstUnknown)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.0-keep", "latest"}, tags)
+
+	for _, image := range []string{dstProtected, dstCache, dstOther, dstSibling} {
+		tags, err := crane.ListTags(image)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"1.0", "latest"}, tags, image)
+	}
+
+	tags, err = crane.ListTags(dstFoo)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.0", "1.1", "latest"}, tags)
+}
+
+func TestPurgeRetention(t *testing.T) {
+	env := map[string]string{
+		"REGISTRY_STORAGE_DELETE_ENABLED": "true",
+	}
+
+	dstip, dstport, err := startRegistry(env, nil, nil)
+	require.NoError(t, err)
+	dstRegistry := fmt.Sprintf("%s:%d", dstip, dstport)
+
+	day := 24 * time.Hour
+	dstAlpine := fmt.Sprintf("%s/library/alpine", dstRegistry)
+	dstNightly := fmt.Sprintf("%s/library/nightly", dstRegistry)
+	for tag, age := range map[string]time.Duration{"1.0": 100 * day, "1.1": 50 * day, "1.2": 5 * day, "2.0": day} {
+		err = createImageCreatedAt(dstAlpine+":"+tag, time.Now().Add(-age))
+		require.NoError(t, err)
+	}
+	for tag, age := range map[string]time.Duration{"a": 3 * day, "b": 2 * day, "c": day} {
+		err = createImageCreatedAt(dstNightly+":"+tag, time.Now().Add(-age))
+		require.NoError(t, err)
+	}
+
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source:      dstAlpine,
+				Destination: "http://" + dstAlpine,
+				Match: apiv1.Match{
+					Semver: new(">= 1.0"),
+				},
+				Purge: &apiv1.Purge{
+					Retention: &apiv1.Retention{
+						OlderThan:   "720h",
+						KeepAtLeast: new(int64(3)),
+					},
+				},
+			},
+			{
+				Source:      dstNightly,
+				Destination: "http://" + dstNightly,
+				Match: apiv1.Match{
+					AllTags: true,
+				},
+				Purge: &apiv1.Purge{
+					Retention: &apiv1.Retention{
+						KeepLast: new(int64(2)),
+						SortBy:   apiv1.RetentionSortCreated,
+					},
+				},
+			},
+		},
+	}
+
+	m := container.New(slog.Default(), config, nil)
+	err = m.Purge(context.Background())
+	require.NoError(t, err)
+
+	// 1.1 is older than 30 days, but one of the 3 newest tags
+	tags, err := crane.ListTags(dstAlpine)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.1", "1.2", "2.0"}, tags)
+
+	tags, err = crane.ListTags(dstNightly)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"b", "c"}, tags)
+}
+
+// createImageCreatedAt pushes an image with a synthetic creation time
+func createImageCreatedAt(ref string, created time.Time) error {
+	img, err := random.Image(128, 1)
+	if err != nil {
+		return err
+	}
+	img, err = mutate.CreatedAt(img, v1.Time{Time: created})
+	if err != nil {
+		return err
+	}
+	return crane.Push(img, ref)
+}
+
+func TestPurgeDryRun(t *testing.T) {
+	env := map[string]string{
+		"REGISTRY_STORAGE_DELETE_ENABLED": "true",
+	}
+
+	dstip, dstport, err := startRegistry(env, nil, nil)
+	require.NoError(t, err)
+	dstRegistry := fmt.Sprintf("%s:%d", dstip, dstport)
+
+	dstAlpine := fmt.Sprintf("%s/library/alpine", dstRegistry)
+	for _, tag := range []string{"foo", "3.15", "3.16", "3.17"} {
+		err = createImage(dstAlpine, tag)
+		require.NoError(t, err)
+	}
+	digest, err := crane.Digest(dstAlpine + ":3.15")
+	require.NoError(t, err)
+
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source:      dstAlpine,
+				Destination: "http://" + dstAlpine,
+				Match: apiv1.Match{
+					Semver: new(">= 3.17"),
+				},
+				Purge: &apiv1.Purge{
+					Semver: new("<= 3.15"),
+				},
+			},
+		},
+	}
+
+	m := container.New(slog.Default(), config, nil)
+	m.SetDryRun(true)
+	err = m.Purge(context.Background())
+	require.NoError(t, err)
+
+	require.Equal(t, []container.Action{
+		{Operation: container.OperationDelete, Destination: dstAlpine + ":3.15", Digest: digest},
+	}, m.Plan())
+
+	tags, err := crane.ListTags(dstAlpine)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"foo", "3.15", "3.16", "3.17", "latest"}, tags)
+}
+
+func TestPurgeSharedDigest(t *testing.T) {
+	env := map[string]string{
+		"REGISTRY_STORAGE_DELETE_ENABLED": "true",
+	}
+
+	dstip, dstport, err := startRegistry(env, nil, nil)
+	require.NoError(t, err)
+	dstRegistry := fmt.Sprintf("%s:%d", dstip, dstport)
+
+	dstAlpine := fmt.Sprintf("%s/library/alpine", dstRegistry)
+	err = createImage(dstAlpine, "0.8", "0.8.0")
+	require.NoError(t, err)
+	err = createImage(dstAlpine, "0.9")
+	require.NoError(t, err)
+	// 1.0 is also pushed as latest
+	err = createImage(dstAlpine, "1.0", "stable")
+	require.NoError(t, err)
+	digest, err := crane.Digest(dstAlpine + ":1.0")
+	require.NoError(t, err)
+
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source:      dstAlpine,
+				Destination: "http://" + dstAlpine,
+				Match: apiv1.Match{
+					Semver: new(">= 1.0"),
+				},
+				Purge: &apiv1.Purge{
+					Tags: []string{"0.8", "0.8.0", "0.9", "1.0"},
+				},
+			},
+		},
+	}
+
+	m := container.New(slog.Default(), config, nil)
+	m.SetDryRun(true)
+	err = m.Purge(context.Background())
+	require.NoError(t, err)
+	require.Contains(t, m.Plan(), container.Action{Operation: container.OperationKeep, Destination: dstAlpine + ":1.0", Digest: digest})
+
+	m = container.New(slog.Default(), config, nil)
+	err = m.Purge(context.Background())
+	require.NoError(t, err)
+
+	tags, err := crane.ListTags(dstAlpine)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.0", "stable", "latest"}, tags)
+}
+
+func TestPurgeRewrittenTags(t *testing.T) {
+	env := map[string]string{
+		"REGISTRY_STORAGE_DELETE_ENABLED": "true",
+	}
+
+	srcip, srcport, err := startRegistry(nil, nil, nil)
+	require.NoError(t, err)
+	srcRegistry := fmt.Sprintf("%s:%d", srcip, srcport)
+
+	dstip, dstport, err := startRegistry(env, nil, nil)
+	require.NoError(t, err)
+	dstRegistry := fmt.Sprintf("%s:%d", dstip, dstport)
+
+	srcFoo := fmt.Sprintf("%s/library/foo", srcRegistry)
+	dstFoo := fmt.Sprintf("%s/library/foo", dstRegistry)
+	for _, tag := range []string{"v1.0.0", "v1.1.0", "v1.2.0"} {
+		err = createImage(srcFoo, tag)
+		require.NoError(t, err)
+	}
+	// a tag which was mirrored before, but is not matched anymore
+	err = crane.Copy(srcFoo+":v1.0.0", dstFoo+":1.0.0")
+	require.NoError(t, err)
+
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source:      srcFoo,
+				Destination: "http://" + dstFoo,
+				Match: apiv1.Match{
+					Semver: new(">= 1.1"),
+				},
+				Purge: &apiv1.Purge{
+					NoMatch: true,
+				},
+				Rewrite: &apiv1.TagRewrite{
+					Regex: new("^v"),
+				},
+			},
+		},
+	}
+
+	m := container.New(slog.Default(), config, nil)
+	err = m.Mirror(context.Background())
+	require.NoError(t, err)
+
+	tags, err := crane.ListTags(dstFoo)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.0.0", "1.1.0", "1.2.0"}, tags)
+
+	err = m.Purge(context.Background())
+	require.NoError(t, err)
+
+	tags, err = crane.ListTags(dstFoo)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.1.0", "1.2.0"}, tags)
+
+	err = m.PurgeUnknown(context.Background())
+	require.NoError(t, err)
+
+	tags, err = crane.ListTags(dstFoo)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.1.0", "1.2.0"}, tags)
 }
@@ -0,0 +1,118 @@
+package container
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+)
+
+// purgeCandidates are the tags the purge of one image is decided on, they are read once per image
+type purgeCandidates struct {
+	// tags of the destination image
+	tags []string
+	// mirrored are the destination tags of the tags matched in the source, only read if no_match is set
+	mirrored []string
+	// expired are the tags purged by the retention rules
+	expired []string
+	// retained are the tags kept by retention.keep_at_least
+	retained []string
+}
+
+// purgeCandidates reads the destination tags, the source tags and the retention properties of the image,
+// the source tags are shared by all destinations of the image and only listed if they are needed
+func (m *mirror) purgeCandidates(image apiv1.ImageMirror, sourceTags func() ([]string, error), opts []crane.Option) (purgeCandidates, error) {
+	var (
+		candidates purgeCandidates
+		err        error
+	)
+	candidates.tags, err = m.listTags(image.Destination, opts)
+	if err != nil {
+		return candidates, err
+	}
+
+	if image.Purge.Retention != nil {
+		candidates.expired, candidates.retained, err = m.retention(image, candidates.tags, opts)
+		if err != nil {
+			return candidates, err
+		}
+	}
+
+	if image.Purge.NoMatch {
+		srcTags, err := sourceTags()
+		if err != nil {
+			return candidates, err
+		}
+		tagsToCopy, err := m.selectTags(image, srcTags)
+		if err != nil {
+			return candidates, err
+		}
+		for _, dst := range tagsToCopy.destinationTags() {
+			candidates.mirrored = append(candidates.mirrored, strings.TrimPrefix(dst, image.Destination+":"))
+		}
+	}
+	return candidates, nil
+}
+
+// planPurge decides which tags of the image are purged and which are kept, it does not access any registry.
+// latest and tags kept by retention.keep_at_least are never purged.
+func (m *mirror) planPurge(image apiv1.ImageMirror, candidates purgeCandidates) (purge, keep []string, err error) {
+	regex, err := compileRegex(image.Purge.Regex)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var errs []error
+	for _, tag := range candidates.tags {
+		// never purge latest
+		if tag == "latest" {
+			keep = append(keep, tag)
+			continue
+		}
+
+		matched, err := m.purgeMatches(image, regex, candidates, tag)
+		if err != nil {
+			errs = append(errs, err)
+			keep = append(keep, tag)
+			continue
+		}
+		if matched && slices.Contains(candidates.retained, tag) {
+			m.log.Info("image is kept by retention.keep_at_least", "image", image.Destination+":"+tag)
+			matched = false
+		}
+		if matched {
+			purge = append(purge, tag)
+		} else {
+			keep = append(keep, tag)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	return purge, keep, nil
+}
+
+// purgeMatches returns true if the tag is matched by any of the purge criteria of the image
+func (m *mirror) purgeMatches(image apiv1.ImageMirror, regex *regexp.Regexp, candidates purgeCandidates, tag string) (bool, error) {
+	if slices.Contains(image.Purge.Tags, tag) || slices.Contains(candidates.expired, tag) {
+		return true, nil
+	}
+
+	ok, err := patternMatches(regex, image.Purge.Glob, tag)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	if image.Purge.Semver != nil {
+		ok, err := m.tagMatches(image.Destination, tag, *image.Purge.Semver, false)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+
+	return image.Purge.NoMatch && !slices.Contains(candidates.mirrored, tag), nil
+}
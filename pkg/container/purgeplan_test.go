@@ -0,0 +1,135 @@
+package container
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanPurge(t *testing.T) {
+	tags := []string{"1.0", "1.1", "1.2", "2.0", "2.1", "nightly", "stable", "latest"}
+
+	tests := []struct {
+		name       string
+		purge      apiv1.Purge
+		candidates purgeCandidates
+		wantPurge  []string
+		wantKeep   []string
+		wantErr    bool
+	}{
+		{
+			name:      "tags and semver",
+			purge:     apiv1.Purge{Tags: []string{"nightly", "latest"}, Semver: new("< 1.2")},
+			wantPurge: []string{"1.0", "1.1", "nightly"},
+			wantKeep:  []string{"1.2", "2.0", "2.1", "stable", "latest"},
+		},
+		{
+			name:       "no match",
+			purge:      apiv1.Purge{NoMatch: true},
+			candidates: purgeCandidates{mirrored: []string{"2.0", "2.1", "stable"}},
+			wantPurge:  []string{"1.0", "1.1", "1.2", "nightly"},
+			wantKeep:   []string{"2.0", "2.1", "stable", "latest"},
+		},
+		{
+			name:      "no match without any mirrored tag",
+			purge:     apiv1.Purge{NoMatch: true},
+			wantPurge: []string{"1.0", "1.1", "1.2", "2.0", "2.1", "nightly", "stable"},
+			wantKeep:  []string{"latest"},
+		},
+		{
+			name:       "retention",
+			purge:      apiv1.Purge{Glob: new("1.*")},
+			candidates: purgeCandidates{expired: []string{"nightly"}, retained: []string{"1.2", "2.0"}},
+			wantPurge:  []string{"1.0", "1.1", "nightly"},
+			wantKeep:   []string{"1.2", "2.0", "2.1", "stable", "latest"},
+		},
+		{
+			name:    "invalid semver",
+			purge:   apiv1.Purge{Semver: new("not a constraint")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(slog.New(slog.DiscardHandler), apiv1.Config{}, nil)
+			tt.candidates.tags = tags
+			purge, keep, err := m.planPurge(apiv1.ImageMirror{Source: "src/busybox", Destination: "dst/busybox", Purge: &tt.purge}, tt.candidates)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.ElementsMatch(t, tt.wantPurge, purge)
+			require.ElementsMatch(t, tt.wantKeep, keep)
+		})
+	}
+}
+
+func TestPurgeListsTagsOnce(t *testing.T) {
+	tagLists := make(map[string]int)
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if repo, ok := strings.CutSuffix(r.URL.Path, "/tags/list"); ok {
+			tagLists[strings.TrimPrefix(repo, "/v2/")]++
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, ref := range []string{
+		"src/busybox:1.0", "src/busybox:1.1",
+		"dst/busybox:1.0", "dst/busybox:1.1", "dst/busybox:0.9", "dst/busybox:0.8",
+		"dst2/busybox:1.1", "dst2/busybox:0.9",
+	} {
+		// a digest shared with a kept tag would not be purged
+		img, err := random.Image(128, 1)
+		require.NoError(t, err)
+		r, err := name.ParseReference(host + "/" + ref)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(r, img))
+	}
+
+	m := New(slog.New(slog.DiscardHandler), apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{
+				Source: host + "/src/busybox",
+				Destinations: []apiv1.Destination{
+					{Destination: host + "/dst/busybox"},
+					{Destination: host + "/dst2/busybox"},
+				},
+				Match: apiv1.Match{Semver: new(">= 1.0")},
+				Purge: &apiv1.Purge{NoMatch: true},
+			},
+		},
+	}, nil)
+	m.SetDryRun(true)
+
+	// the source is listed once for all destinations
+	require.NoError(t, m.Purge(context.Background()))
+	require.Equal(t, map[string]int{"src/busybox": 1, "dst/busybox": 1, "dst2/busybox": 1}, tagLists)
+	var purged []string
+	for _, action := range m.Plan() {
+		if action.Operation == OperationDelete {
+			purged = append(purged, action.Destination)
+		}
+	}
+	require.ElementsMatch(t, []string{host + "/dst/busybox:0.8", host + "/dst/busybox:0.9", host + "/dst2/busybox:0.9"}, purged)
+
+	clear(tagLists)
+	require.NoError(t, m.PurgeUnknown(context.Background()))
+	// once for all destinations and once as repository of the destination registry
+	require.Equal(t, 2, tagLists["src/busybox"])
+}
@@ -0,0 +1,186 @@
+package container
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+)
+
+// cosignTagSuffixes are the suffixes of the tags cosign stores signatures, attestations and SBOMs of a digest with
+var cosignTagSuffixes = []string{".sig", ".att", ".sbom"}
+
+// referrerTagPattern matches the tag schema fallback of the referrers API and the cosign tags, the subject digest is the first group
+var referrerTagPattern = regexp.MustCompile(`^sha256-([a-f0-9]{64})(\.sig|\.att|\.sbom)?$`)
+
+// referrer is a manifest which refers to a subject digest
+type referrer struct {
+	// digest of the referring manifest
+	digest string
+	// tag of the referrer, empty if it was discovered by the referrers API
+	tag string
+	// fallback is true for the image index of the referrers tag schema, it is maintained by the registry client which pushes a referrer
+	fallback bool
+}
+
+// referrerSubject returns the subject digest of a referrer tag or a reference with a referrer tag,
+// empty if it is no referrer tag
+func referrerSubject(ref string) string {
+	match := referrerTagPattern.FindStringSubmatch(ref[strings.LastIndex(ref, ":")+1:])
+	if match == nil {
+		return ""
+	}
+	return "sha256:" + match[1]
+}
+
+// referrers discovers all manifests in the repository which refer to the digest, also the referrers of referrers,
+// e.g. the signature of an attestation. Referrers are returned after the manifest they refer to.
+func (m *mirror) referrers(repository, digest string, opts []crane.Option) ([]referrer, error) {
+	var (
+		result  []referrer
+		queue   = []string{digest}
+		visited = map[string]bool{digest: true}
+	)
+	for len(queue) > 0 {
+		subject := queue[0]
+		queue = queue[1:]
+		referrers, err := m.directReferrers(repository, subject, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range referrers {
+			if visited[r.digest] {
+				continue
+			}
+			visited[r.digest] = true
+			result = append(result, r)
+			if !r.fallback {
+				queue = append(queue, r.digest)
+			}
+		}
+	}
+	return result, nil
+}
+
+// directReferrers discovers the manifests which refer to the digest with the referrers API or its tag schema fallback
+// and by the cosign tags sha256-<digest>.sig, .att and .sbom
+func (m *mirror) directReferrers(repository, digest string, opts []crane.Option) ([]referrer, error) {
+	o := crane.GetOptions(opts...)
+	subject, err := name.NewDigest(repository+"@"+digest, o.Name...)
+	if err != nil {
+		return nil, err
+	}
+
+	var idx v1.ImageIndex
+	err = m.withRetry("referrers", subject.String(), func() error {
+		var err2 error
+		idx, err2 = remote.Referrers(subject, o.Remote...)
+		return err2
+	})
+	if err != nil {
+		m.log.Error("unable to list referrers", "image", subject.String(), "error", err)
+		return nil, err
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	// tagged referrers first, a cosign tag can also be listed by the referrers API
+	var result []referrer
+	tagPrefix := strings.Replace(digest, ":", "-", 1)
+	for _, suffix := range append([]string{""}, cosignTagSuffixes...) {
+		tag := tagPrefix + suffix
+		referrerDigest, err := crane.Digest(repository+":"+tag, opts...)
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			m.log.Error("unable to read referrer tag", "image", repository+":"+tag, "error", err)
+			return nil, err
+		}
+		result = append(result, referrer{digest: referrerDigest, tag: tag, fallback: suffix == ""})
+	}
+	for _, desc := range manifest.Manifests {
+		result = append(result, referrer{digest: desc.Digest.String()})
+	}
+	return result, nil
+}
+
+// mirrorReferrers copies the signatures, attestations and SBOMs of the source manifest to the destination,
+// the cosign tags are copied unchanged, referrers without tag by their digest.
+func (m *mirror) mirrorReferrers(target *mirrorTarget, source *sourceManifest) error {
+	image := target.image
+	err := m.readManifest(source, target.opts)
+	if err != nil {
+		return err
+	}
+	switch {
+	case source.kind == manifestKindSchema1 || source.kind == manifestKindUnknown:
+		return nil
+	case len(image.Platforms) > 0:
+		m.log.Warn("referrers are not mirrored for images reduced to platforms, their digest differs from the source", "image", source.src)
+		return nil
+	}
+
+	digest := source.desc.Digest.String()
+	if !target.claimReferrers(digest) {
+		return nil
+	}
+
+	srcRef, err := name.ParseReference(source.src)
+	if err != nil {
+		return err
+	}
+	repository := srcRef.Context().Name()
+	referrers, err := m.referrers(repository, digest, target.opts)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, r := range referrers {
+		// the fallback index of the destination is updated when the referrers are pushed
+		if r.fallback {
+			continue
+		}
+		src, dst := repository+"@"+r.digest, image.Destination+"@"+r.digest
+		if r.tag != "" {
+			src, dst = repository+":"+r.tag, image.Destination+":"+r.tag
+		}
+		if err := m.mirrorReferrer(image, src, dst, target.opts); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// mirrorReferrer copies a single referrer unless it is already present in the destination
+func (m *mirror) mirrorReferrer(image apiv1.ImageMirror, src, dst string, opts []crane.Option) error {
+	o := crane.GetOptions(opts...)
+	dstRef, err := name.ParseReference(dst, o.Name...)
+	if err != nil {
+		return err
+	}
+
+	m.log.Info("mirror referrer from", "source", src, "destination", dst)
+	existing, err := crane.Digest(dst, opts...)
+	if err != nil {
+		existing = ""
+	}
+	source := &sourceManifest{src: src}
+	if err := m.readManifest(source, opts); err != nil {
+		return err
+	}
+	return m.writeTag(image, src, dst, existing, source.desc, func() error {
+		return remote.Push(dstRef, source.desc, o.Remote...)
+	})
+}
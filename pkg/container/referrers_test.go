@@ -0,0 +1,180 @@
+package container
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferrerSubject(t *testing.T) {
+	hex := strings.Repeat("a", 64)
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{ref: "sha256-" + hex, want: "sha256:" + hex},
+		{ref: "sha256-" + hex + ".sig", want: "sha256:" + hex},
+		{ref: "localhost:5000/library/busybox:sha256-" + hex + ".att", want: "sha256:" + hex},
+		{ref: "sha256-" + hex + ".sbom", want: "sha256:" + hex},
+		{ref: "sha256-" + hex + ".unknown"},
+		{ref: "sha256-" + hex[:10]},
+		{ref: "localhost:5000/library/busybox:1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			require.Equal(t, tt.want, referrerSubject(tt.ref))
+		})
+	}
+}
+
+func TestMirrorReferrers(t *testing.T) {
+	newRegistry := func(opts ...registry.Option) string {
+		srv := httptest.NewServer(registry.New(append(opts, registry.Logger(log.New(io.Discard, "", 0)))...))
+		t.Cleanup(srv.Close)
+		return strings.TrimPrefix(srv.URL, "http://")
+	}
+	// the source supports the referrers API, the destination only the tag schema fallback
+	src := newRegistry(registry.WithReferrersSupport(true)) + "/library/busybox"
+	dst := newRegistry() + "/library/busybox"
+
+	push := func(ref string, taggable interface {
+		remote.Taggable
+		Digest() (v1.Hash, error)
+	}) v1.Hash {
+		r, err := name.ParseReference(ref)
+		require.NoError(t, err)
+		require.NoError(t, remote.Push(r, taggable))
+		digest, err := taggable.Digest()
+		require.NoError(t, err)
+		return digest
+	}
+	idx, err := random.Index(128, 1, 2)
+	require.NoError(t, err)
+	digest := push(src+":1.0", idx)
+	idx2, err := random.Index(128, 1, 2)
+	require.NoError(t, err)
+	push(src+":2.0", idx2)
+
+	// a cosign signature tag and an attestation which is only discoverable by the referrers API
+	signatureTag := strings.Replace(digest.String(), ":", "-", 1) + ".sig"
+	signature, err := random.Image(64, 1)
+	require.NoError(t, err)
+	signatureDigest := push(src+":"+signatureTag, signature)
+	subjectRef, err := name.NewDigest(src + "@" + digest.String())
+	require.NoError(t, err)
+	subject, err := remote.Get(subjectRef)
+	require.NoError(t, err)
+	attestation, err := random.Image(64, 1)
+	require.NoError(t, err)
+	attestation = mutate.ConfigMediaType(attestation, types.MediaType("application/vnd.in-toto+json"))
+	attestation = mutate.Subject(attestation, subject.Descriptor).(v1.Image)
+	attestationDigest, err := attestation.Digest()
+	require.NoError(t, err)
+	push(src+"@"+attestationDigest.String(), attestation)
+
+	config := apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{Source: src, Destination: dst, Match: apiv1.Match{Semver: new(">= 1.0")}, IncludeReferrers: true},
+		},
+	}
+	require.NoError(t, config.Validate())
+	require.NoError(t, New(slog.New(slog.DiscardHandler), config, nil).Mirror(context.Background()))
+
+	got, err := crane.Digest(dst + ":" + signatureTag)
+	require.NoError(t, err)
+	require.Equal(t, signatureDigest.String(), got)
+
+	dstRef, err := name.NewDigest(dst + "@" + digest.String())
+	require.NoError(t, err)
+	referrers, err := remote.Referrers(dstRef)
+	require.NoError(t, err)
+	manifest, err := referrers.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Manifests, 1)
+	require.Equal(t, attestationDigest, manifest.Manifests[0].Digest)
+
+	tags, err := crane.ListTags(dst)
+	require.NoError(t, err)
+	fallbackTag := strings.Replace(digest.String(), ":", "-", 1)
+	require.ElementsMatch(t, []string{"1.0", "2.0", signatureTag, fallbackTag}, tags)
+
+	// the referrers of kept images are not purged as unknown tags
+	config.Images[0].Purge = &apiv1.Purge{NoMatch: true}
+	m := New(slog.New(slog.DiscardHandler), config, nil)
+	m.SetDryRun(true)
+	require.NoError(t, m.Purge(context.Background()))
+	require.Empty(t, m.Plan())
+
+	// the referrers are purged with the image they refer to
+	config.Images[0].Purge = &apiv1.Purge{Tags: []string{"1.0"}}
+	m = New(slog.New(slog.DiscardHandler), config, nil)
+	m.SetDryRun(true)
+	require.NoError(t, m.Purge(context.Background()))
+	fallbackDigest, err := crane.Digest(dst + ":" + fallbackTag)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []Action{
+		{Operation: OperationDelete, Destination: dst + ":" + fallbackTag, Digest: fallbackDigest},
+		{Operation: OperationDelete, Destination: dst + ":" + signatureTag, Digest: signatureDigest.String()},
+		{Operation: OperationDelete, Destination: dst + "@" + attestationDigest.String(), Digest: attestationDigest.String()},
+		{Operation: OperationDelete, Destination: dst + ":1.0", Digest: digest.String()},
+	}, m.Plan())
+}
+
+func TestPurgeReferrersUnavailable(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		deleted []string
+	)
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/referrers/") {
+			http.Error(w, "proxy error", http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			mu.Lock()
+			deleted = append(deleted, r.URL.Path)
+			mu.Unlock()
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	repository := strings.TrimPrefix(srv.URL, "http://") + "/library/busybox"
+
+	for _, tag := range []string{"1.0", "2.0"} {
+		img, err := random.Image(64, 1)
+		require.NoError(t, err)
+		require.NoError(t, crane.Push(img, repository+":"+tag))
+	}
+	digest, err := crane.Digest(repository + ":1.0")
+	require.NoError(t, err)
+
+	// server errors are not retried by the transport
+	noRetry := func(o *crane.Options) {
+		o.Remote = append(o.Remote, remote.WithRetryBackoff(remote.Backoff{Steps: 1}))
+	}
+	m := New(slog.New(slog.DiscardHandler), apiv1.Config{}, nil)
+	err = m.purge(repository, []string{repository + ":1.0"}, []string{repository + ":2.0"}, []crane.Option{noRetry})
+	require.ErrorContains(t, err, "unable to list referrers")
+	// the digest is kept, so that the next purge can find its referrers
+	require.Empty(t, deleted)
+	_, err = crane.Head(repository + "@" + digest)
+	require.NoError(t, err)
+}
@@ -1,6 +1,16 @@
 package container
 
-import "net/url"
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+)
 
 // registryTarget defines if the Registry is a source or destination registry
 type registryTarget string
@@ -12,25 +22,90 @@ const (
 	destinationRegistry = registryTarget("destination")
 )
 
-// affectedRegistries returns a slice of all registries of sources and destinations
-func (m *mirror) affectedRegistries(target registryTarget) ([]string, error) {
-	var (
-		result     []string
-		registries = make(map[string]bool)
-	)
-	for _, image := range m.config.Images {
-		registry := image.Destination
+// catalogPageSize is the number of repositories requested per catalog page
+const catalogPageSize = 100
+
+// affectedRegistry is a registry of sources or destinations
+type affectedRegistry struct {
+	// name of the registry, e.g. index.docker.io or localhost:5000
+	name string
+	// insecure is true if any image of this registry is prefixed with http://
+	insecure bool
+}
+
+// affectedRegistries returns a slice of all registries of sources and destinations sorted by name
+func (m *mirror) affectedRegistries(target registryTarget) ([]affectedRegistry, error) {
+	registries := make(map[string]bool)
+	for _, image := range m.imageMirrors() {
+		ref := image.Destination
 		if target == sourceRegistry {
-			registry = image.Source
+			ref = image.Source
+		} else if _, _, ok := apiv1.ParseArchive(ref); ok {
+			continue
 		}
-		parsed, err := url.Parse(registry)
+		insecure := strings.HasPrefix(ref, "http://")
+		parsed, err := name.ParseReference(strings.TrimPrefix(ref, "http://"))
 		if err != nil {
 			return nil, err
 		}
-		registries[parsed.Host] = true
+		registry := parsed.Context().Registry.Name()
+		registries[registry] = registries[registry] || insecure
 	}
-	for registry := range registries {
-		result = append(result, registry)
+
+	var result []affectedRegistry
+	for _, registry := range slices.Sorted(maps.Keys(registries)) {
+		result = append(result, affectedRegistry{name: registry, insecure: registries[registry]})
 	}
 	return result, nil
 }
+
+// registryOptions returns the crane options to access the registry with its configured credentials
+func (m *mirror) registryOptions(ctx context.Context, registry affectedRegistry) []crane.Option {
+	opts := []crane.Option{
+		crane.WithAuthFromKeychain(m.registryKeychain(registry.name)),
+		crane.WithContext(ctx),
+	}
+	if registry.insecure {
+		opts = append(opts, crane.Insecure)
+	}
+	return opts
+}
+
+// catalog lists all repositories of the registry page by page
+func (m *mirror) catalog(registry affectedRegistry, opts []crane.Option) ([]string, error) {
+	o := crane.GetOptions(opts...)
+	reg, err := name.NewRegistry(registry.name, o.Name...)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		repos []string
+		last  string
+		seen  = make(map[string]bool)
+	)
+	for {
+		var page []string
+		err := m.withRetry("catalog", registry.name, func() error {
+			var err2 error
+			page, err2 = remote.CatalogPage(reg, last, catalogPageSize, o.Remote...)
+			return err2
+		})
+		if err != nil {
+			return nil, err
+		}
+		added := 0
+		for _, repo := range page {
+			if !seen[repo] {
+				seen[repo] = true
+				repos = append(repos, repo)
+				added++
+			}
+		}
+		// registries without pagination support return the same page again
+		if added == 0 || len(page) < catalogPageSize {
+			return repos, nil
+		}
+		last = page[len(page)-1]
+	}
+}
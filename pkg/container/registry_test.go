@@ -0,0 +1,99 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAffectedRegistries(t *testing.T) {
+	m := New(slog.New(slog.DiscardHandler), apiv1.Config{
+		Images: []apiv1.ImageMirror{
+			{Source: "alpine", Destination: "localhost:5000/library/alpine"},
+			{Source: "busybox", Destination: "http://localhost:5000/library/busybox"},
+			{Source: "quay.io/foo/bar", Destinations: []apiv1.Destination{
+				{Destination: "r.example.com/foo/bar"},
+				{Destination: "http://10.0.0.1:5000/foo/bar"},
+				{Destination: "oci-layout:///var/lib/mirror"},
+			}},
+		},
+	}, nil)
+
+	registries, err := m.affectedRegistries(destinationRegistry)
+	require.NoError(t, err)
+	require.Equal(t, []affectedRegistry{
+		{name: "10.0.0.1:5000", insecure: true},
+		{name: "localhost:5000", insecure: true},
+		{name: "r.example.com"},
+	}, registries)
+
+	registries, err = m.affectedRegistries(sourceRegistry)
+	require.NoError(t, err)
+	require.Equal(t, []affectedRegistry{
+		{name: "index.docker.io"},
+		{name: "quay.io"},
+	}, registries)
+}
+
+func TestCatalog(t *testing.T) {
+	var all []string
+	for i := range 250 {
+		all = append(all, fmt.Sprintf("library/image-%03d", i))
+	}
+
+	tests := []struct {
+		name       string
+		pagination bool
+		want       []string
+	}{
+		{
+			name:       "paginated",
+			pagination: true,
+			want:       all,
+		},
+		{
+			name:       "pagination not supported",
+			pagination: false,
+			want:       all[:catalogPageSize],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v2/_catalog" {
+					return
+				}
+				requests++
+				repos := all
+				if tt.pagination {
+					if last := r.URL.Query().Get("last"); last != "" {
+						idx, _ := slices.BinarySearch(repos, last)
+						repos = repos[idx+1:]
+					}
+				}
+				n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+				repos = repos[:min(n, len(repos))]
+				_ = json.NewEncoder(w).Encode(map[string][]string{"repositories": repos})
+			}))
+			defer srv.Close()
+
+			m := New(slog.New(slog.DiscardHandler), apiv1.Config{}, nil)
+			registry := affectedRegistry{name: strings.TrimPrefix(srv.URL, "http://"), insecure: true}
+			repos, err := m.catalog(registry, []crane.Option{crane.Insecure})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, repos)
+			require.LessOrEqual(t, requests, 3)
+		})
+	}
+}
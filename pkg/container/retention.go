@@ -0,0 +1,116 @@
+package container
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+)
+
+// retainedTag is a destination tag with the properties the retention rules are evaluated on
+type retainedTag struct {
+	tag string
+	// version is nil if the tag is no semantic version
+	version *semver.Version
+	// created is zero if the creation time is unknown or was not read
+	created time.Time
+}
+
+// applyRetention returns the tags which are purged by the retention rules
+// and the tags which are kept by keep_at_least regardless of any other purge criteria.
+func applyRetention(retention apiv1.Retention, tags []retainedTag, now time.Time) (purge, keep []string, err error) {
+	var cutoff time.Time
+	if retention.OlderThan != "" {
+		olderThan, err := time.ParseDuration(retention.OlderThan)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse older_than:%q %w", retention.OlderThan, err)
+		}
+		cutoff = now.Add(-olderThan)
+	}
+
+	byCreated := retention.SortBy == apiv1.RetentionSortCreated
+	// tags without the property to sort by have no rank, they are neither purged nor kept by their number
+	var ranked []retainedTag
+	for _, t := range tags {
+		if (byCreated && !t.created.IsZero()) || (!byCreated && t.version != nil) {
+			ranked = append(ranked, t)
+		}
+	}
+	// newest first
+	slices.SortStableFunc(ranked, func(a, b retainedTag) int {
+		if byCreated {
+			return cmp.Or(b.created.Compare(a.created), cmp.Compare(a.tag, b.tag))
+		}
+		return cmp.Or(b.version.Compare(a.version), cmp.Compare(a.tag, b.tag))
+	})
+	ranks := make(map[string]int64)
+	for i, t := range ranked {
+		ranks[t.tag] = int64(i)
+	}
+
+	for _, t := range tags {
+		rank, ok := ranks[t.tag]
+		switch {
+		case ok && retention.KeepAtLeast != nil && rank < *retention.KeepAtLeast:
+			keep = append(keep, t.tag)
+		case ok && retention.KeepLast != nil && rank >= *retention.KeepLast:
+			purge = append(purge, t.tag)
+		case !cutoff.IsZero() && !t.created.IsZero() && t.created.Before(cutoff):
+			purge = append(purge, t.tag)
+		}
+	}
+	return purge, keep, nil
+}
+
+// retention evaluates the retention rules of the image against the tags in the destination
+func (m *mirror) retention(image apiv1.ImageMirror, tags []string, opts []crane.Option) (purge, keep []string, err error) {
+	retention := *image.Purge.Retention
+	readCreated := retention.SortBy == apiv1.RetentionSortCreated || retention.OlderThan != ""
+
+	var retained []retainedTag
+	for _, tag := range tags {
+		// never purge latest
+		if tag == "latest" {
+			continue
+		}
+		t := retainedTag{tag: tag}
+		if v, err := semver.NewVersion(tag); err == nil {
+			t.version = v
+		}
+		if readCreated {
+			t.created, err = m.imageCreated(image.Destination+":"+tag, opts)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		retained = append(retained, t)
+	}
+	return applyRetention(retention, retained, time.Now())
+}
+
+// imageCreated returns the creation time of the image config, for multi-platform images of the linux/amd64 image
+func (m *mirror) imageCreated(ref string, opts []crane.Option) (time.Time, error) {
+	var raw []byte
+	err := m.withRetry("read_config", ref, func() error {
+		var err2 error
+		raw, err2 = crane.Config(ref, opts...)
+		return err2
+	})
+	if err != nil {
+		m.log.Error("unable to read image config", "image", ref, "error", err)
+		return time.Time{}, fmt.Errorf("unable to read image config of %q %w", ref, err)
+	}
+	var config v1.ConfigFile
+	if err := json.Unmarshal(raw, &config); err != nil {
+		// artifacts do not have an image config, their creation time is unknown
+		m.log.Debug("image config has no creation time", "image", ref, "error", err)
+		return time.Time{}, nil
+	}
+	return config.Created.Time, nil
+}
@@ -0,0 +1,84 @@
+package container
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyRetention(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tag := func(tag string, age time.Duration) retainedTag {
+		t := retainedTag{tag: tag, created: now.Add(-age)}
+		if v, err := semver.NewVersion(tag); err == nil {
+			t.version = v
+		}
+		return t
+	}
+	day := 24 * time.Hour
+	// creation order differs from the semver order, 1.9.1 is a rebuilt patch release
+	tags := []retainedTag{
+		tag("1.10.0", 10*day),
+		tag("1.9.0", 40*day),
+		tag("1.9.1", 2*day),
+		tag("1.8.0", 60*day),
+		tag("nightly", 1*day),
+		tag("stable", 90*day),
+	}
+
+	tests := []struct {
+		name      string
+		retention apiv1.Retention
+		wantPurge []string
+		wantKeep  []string
+		wantErr   bool
+	}{
+		{
+			name:      "keep last by semver",
+			retention: apiv1.Retention{KeepLast: new(int64(2))},
+			wantPurge: []string{"1.9.0", "1.8.0"},
+		},
+		{
+			name:      "keep last by creation time",
+			retention: apiv1.Retention{KeepLast: new(int64(2)), SortBy: apiv1.RetentionSortCreated},
+			wantPurge: []string{"1.10.0", "1.9.0", "1.8.0", "stable"},
+		},
+		{
+			name:      "older than",
+			retention: apiv1.Retention{OlderThan: "720h"},
+			wantPurge: []string{"1.9.0", "1.8.0", "stable"},
+		},
+		{
+			name:      "older than keeps at least the newest by semver",
+			retention: apiv1.Retention{OlderThan: "24h", KeepAtLeast: new(int64(3))},
+			wantPurge: []string{"1.8.0", "stable"},
+			wantKeep:  []string{"1.10.0", "1.9.0", "1.9.1"},
+		},
+		{
+			name:      "keep last and older than combined",
+			retention: apiv1.Retention{KeepLast: new(int64(3)), OlderThan: "1000h", SortBy: apiv1.RetentionSortCreated, KeepAtLeast: new(int64(1))},
+			wantPurge: []string{"1.9.0", "1.8.0", "stable"},
+			wantKeep:  []string{"nightly"},
+		},
+		{
+			name:      "invalid duration",
+			retention: apiv1.Retention{OlderThan: "30d"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			purge, keep, err := applyRetention(tt.retention, tags, now)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.ElementsMatch(t, tt.wantPurge, purge)
+			require.ElementsMatch(t, tt.wantKeep, keep)
+		})
+	}
+}
@@ -30,6 +30,7 @@ func (m *mirror) withRetryPolicy(operation, image string, policy *RetryPolicy, f
 		retry.MaxDelay(policy.MaxDelay),
 		retry.RetryIf(isRetryable),
 		retry.OnRetry(func(attempt uint, err error) {
+			m.metrics.retried(operation)
 			m.log.Warn("transient operation failure, retrying", "operation", operation, "image", image, "attempt", attempt+1, "max_attempts", policy.MaxAttempts, "error", err)
 		})).Do(fn)
 
@@ -3,6 +3,9 @@ package container
 import (
 	"errors"
 	"fmt"
+	"maps"
+	"path"
+	"regexp"
 	"slices"
 	"sort"
 
@@ -21,12 +24,13 @@ func (t tagsToCopy) destinationTags() []string {
 	return dsts
 }
 
-func (m *mirror) tagMatches(source, tag, semverstring string) (bool, error) {
+func (m *mirror) tagMatches(source, tag, semverstring string, includePrereleases bool) (bool, error) {
 	c, err := semver.NewConstraint(semverstring)
 	if err != nil {
 		m.log.Error("unable to parse image match pattern", "error", err)
 		return false, err
 	}
+	c.IncludePrerelease = includePrereleases
 	v, err := semver.NewVersion(tag)
 	if err != nil {
 		m.log.Debug("pattern given, ignoring non-semver", "image", source, "tag", tag)
@@ -39,34 +43,162 @@ func (m *mirror) tagMatches(source, tag, semverstring string) (bool, error) {
 	return false, nil
 }
 
-func (m *mirror) getTagsToCopy(image apiv1.ImageMirror, opts []crane.Option) (tagsToCopy, error) {
+// compileRegex compiles the optional regular expression of a match or purge specification
+func compileRegex(regex *string) (*regexp.Regexp, error) {
+	if regex == nil {
+		return nil, nil
+	}
+	re, err := regexp.Compile(*regex)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse regex:%q %w", *regex, err)
+	}
+	return re, nil
+}
+
+// patternMatches reports if the tag matches the regular expression or the glob, both are optional
+func patternMatches(regex *regexp.Regexp, glob *string, tag string) (bool, error) {
+	if regex != nil && regex.MatchString(tag) {
+		return true, nil
+	}
+	if glob == nil {
+		return false, nil
+	}
+	ok, err := path.Match(*glob, tag)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse glob:%q %w", *glob, err)
+	}
+	return ok, nil
+}
+
+// tagRewriter transforms source tags into destination tags
+type tagRewriter struct {
+	regex       *regexp.Regexp
+	replacement string
+	prefix      string
+	suffix      string
+}
+
+func newTagRewriter(rewrite *apiv1.TagRewrite) (*tagRewriter, error) {
+	if rewrite == nil {
+		return nil, nil
+	}
+	regex, err := compileRegex(rewrite.Regex)
+	if err != nil {
+		return nil, err
+	}
+	return &tagRewriter{
+		regex:       regex,
+		replacement: rewrite.Replacement,
+		prefix:      rewrite.Prefix,
+		suffix:      rewrite.Suffix,
+	}, nil
+}
+
+// rewrite returns the destination tag of the given source tag, the tag is returned unchanged if r is nil
+func (r *tagRewriter) rewrite(tag string) string {
+	if r == nil {
+		return tag
+	}
+	if r.regex != nil {
+		tag = r.regex.ReplaceAllString(tag, r.replacement)
+	}
+	return r.prefix + tag + r.suffix
+}
+
+// tagExcluded reports if the tag is excluded by the match of the image
+func (m *mirror) tagExcluded(image apiv1.ImageMirror, regex *regexp.Regexp, tag string) (bool, error) {
+	exclude := image.Match.Exclude
+	if exclude == nil {
+		return false, nil
+	}
+	if slices.Contains(exclude.Tags, tag) {
+		return true, nil
+	}
+	ok, err := patternMatches(regex, exclude.Glob, tag)
+	if err != nil || ok {
+		return ok, err
+	}
+	// prereleases selected by all_tags, glob or regex must not escape the exclusion
+	if exclude.Semver != nil {
+		return m.tagMatches(image.Source, tag, *exclude.Semver, true)
+	}
+	return false, nil
+}
+
+// listTags lists all tags of the image
+func (m *mirror) listTags(image string, opts []crane.Option) ([]string, error) {
+	var tags []string
+	err := m.withRetry("list_tags", image, func() error {
+		var err2 error
+		tags, err2 = crane.ListTags(image, opts...)
+		return err2
+	})
+	if err != nil {
+		m.log.Error("unable to list tags of", "image", image, "error", err)
+		return nil, fmt.Errorf("unable to list tags of image:%q error %w", image, err)
+	}
+	return tags, nil
+}
+
+// selectTags maps the source tags matched by the image to their destination tags
+func (m *mirror) selectTags(image apiv1.ImageMirror, tags []string) (tagsToCopy, error) {
 	var (
 		errs       []error
-		tags       []string
 		tagsToCopy = tagsToCopy{}
 		semverTags []*semver.Version
 	)
 
-	err := m.withRetry("list_tags", image.Source, func() error {
-		var err2 error
-		tags, err2 = crane.ListTags(image.Source, opts...)
-		return err2
-	})
+	regex, err := compileRegex(image.Match.Regex)
 	if err != nil {
-		m.log.Error("unable to list tags of", "image", image.Source, "error", err)
-		return nil, fmt.Errorf("unable to list tags of image:%q error %w", image.Source, err)
+		return nil, err
+	}
+	var excludeRegex *regexp.Regexp
+	if image.Match.Exclude != nil {
+		excludeRegex, err = compileRegex(image.Match.Exclude.Regex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rewriter, err := newTagRewriter(image.Rewrite)
+	if err != nil {
+		return nil, err
 	}
 
 	for _, tag := range tags {
 		src := image.Source + ":" + tag
-		dst := image.Destination + ":" + tag
+		dst := image.Destination + ":" + rewriter.rewrite(tag)
 
-		if slices.Contains(image.Match.Tags, tag) {
+		// explicitly listed tags are never excluded
+		explicit := slices.Contains(image.Match.Tags, tag)
+		if explicit {
+			tagsToCopy[src] = dst
+		}
+
+		excluded, err := m.tagExcluded(image, excludeRegex, tag)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if excluded && !explicit {
+			m.log.Debug("tag is excluded", "image", image.Source, "tag", tag)
+			continue
+		}
+
+		if image.Match.AllTags {
+			tagsToCopy[src] = dst
+		}
+
+		ok, err := patternMatches(regex, image.Match.Glob, tag)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
 			tagsToCopy[src] = dst
 		}
 
 		if image.Match.Semver != nil {
-			ok, err := m.tagMatches(image.Source, tag, *image.Match.Semver)
+			ok, err := m.tagMatches(image.Source, tag, *image.Match.Semver, image.Match.IncludePrereleases)
 			if err != nil {
 				errs = append(errs, err)
 				continue
@@ -89,42 +221,137 @@ func (m *mirror) getTagsToCopy(image apiv1.ImageMirror, opts []crane.Option) (ta
 	sort.Sort(semver.Collection(semverTags))
 
 	if image.Match.Last != nil && semverTags != nil {
-		tagsCount := int64(len(semverTags)) - *image.Match.Last
+		tagsCount := max(int64(len(semverTags))-*image.Match.Last, 0)
 		for _, v := range semverTags[tagsCount:] {
-			if slices.Contains(tags, v.String()) {
-				src := image.Source + ":" + v.String()
-				dst := image.Destination + ":" + v.String()
+			if slices.Contains(tags, v.Original()) {
+				src := image.Source + ":" + v.Original()
+				dst := image.Destination + ":" + rewriter.rewrite(v.Original())
 				tagsToCopy[src] = dst
 			}
 		}
 	}
 
+	// several source tags must not be rewritten to the same destination tag
+	sources := make(map[string]string)
+	for _, src := range slices.Sorted(maps.Keys(tagsToCopy)) {
+		dst := tagsToCopy[src]
+		if other, ok := sources[dst]; ok {
+			errs = append(errs, fmt.Errorf("tags %q and %q are both rewritten to %q", other, src, dst))
+			continue
+		}
+		sources[dst] = src
+	}
+
 	if len(errs) > 0 {
 		return tagsToCopy, errors.Join(errs...)
 	}
 	return tagsToCopy, nil
 }
 
-func (m *mirror) purge(image string, tags []string, opts []crane.Option) error {
+// purge deletes the digests of the given tags, digests which are referenced by any of the kept tags are never deleted
+func (m *mirror) purge(image string, tags, keep []string, opts []crane.Option) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
 	var errs []error
+	// deleting a digest removes all tags which reference it
+	protected := make(map[string][]string)
+	for _, tag := range keep {
+		// referrer tags follow their subject, they do not protect it
+		if referrerSubject(tag) != "" {
+			continue
+		}
+		digest, err := crane.Digest(tag, opts...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to get digest for %q %w", tag, err))
+			continue
+		}
+		protected[digest] = append(protected[digest], tag)
+	}
+	if len(errs) > 0 {
+		// without the digests of all kept tags, a deletion could remove them as well
+		return errors.Join(errs...)
+	}
+
+	// resolve all digests before deleting, a deletion removes the other tags of the same digest
+	digests := make(map[string]string)
 	for _, tag := range tags {
 		digest, err := crane.Digest(tag, opts...)
 		if err != nil {
 			errs = append(errs, fmt.Errorf("unable to get digest for %q %w", tag, err))
 			continue
 		}
+		digests[tag] = digest
+	}
 
-		dst := image + "@" + digest
-		m.log.Info("purge image", "tag", tag, "dst", dst)
-		err = crane.Delete(dst, opts...)
+	deleted := make(map[string]bool)
+	for _, tag := range tags {
+		digest, ok := digests[tag]
+		if !ok {
+			continue
+		}
+		if subject := referrerSubject(tag); subject != "" {
+			if kept, ok := protected[subject]; ok {
+				m.log.Debug("referrer of a kept image, skip purge", "tag", tag, "subject", subject, "kept", kept)
+				continue
+			}
+		}
+		if kept, ok := protected[digest]; ok {
+			m.log.Warn("digest is referenced by kept tags, skip purge image", "tag", tag, "digest", digest, "kept", kept)
+			m.dryRun(Action{Operation: OperationKeep, Destination: tag, Digest: digest})
+			continue
+		}
+		if deleted[digest] {
+			m.log.Info("digest was already purged with another tag", "tag", tag, "digest", digest)
+			continue
+		}
+
+		// signatures, attestations and SBOMs are useless without the digest they refer to,
+		// the digest is kept until they can be listed, otherwise untagged referrers could never be found again
+		referrers, err := m.referrers(image, digest, opts)
 		if err != nil {
-			errs = append(errs, fmt.Errorf("unable to delete digest %q %w", dst, err))
+			errs = append(errs, fmt.Errorf("unable to list referrers of %q %w", tag, err))
 			continue
 		}
-		m.log.Info("purged image", "tag", tag, "dst", dst)
+		deleted[digest] = true
+		for _, r := range referrers {
+			if _, ok := protected[r.digest]; ok || deleted[r.digest] {
+				continue
+			}
+			deleted[r.digest] = true
+			ref := image + "@" + r.digest
+			if r.tag != "" {
+				ref = image + ":" + r.tag
+			}
+			if err := m.deleteDigest(image, ref, r.digest, opts); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if err := m.deleteDigest(image, tag, digest, opts); err != nil {
+			errs = append(errs, err)
+		}
 	}
 	if len(errs) > 0 {
 		return errors.Join(errs...)
 	}
 	return nil
 }
+
+// deleteDigest deletes the digest of the tag in the image repository
+func (m *mirror) deleteDigest(image, tag, digest string, opts []crane.Option) error {
+	dst := image + "@" + digest
+	if m.dryRun(Action{Operation: OperationDelete, Destination: tag, Digest: digest}) {
+		m.log.Info("dry-run, skip purge image", "tag", tag, "dst", dst)
+		return nil
+	}
+	m.log.Info("purge image", "tag", tag, "dst", dst)
+	err := crane.Delete(dst, opts...)
+	if err != nil {
+		return fmt.Errorf("unable to delete digest %q %w", dst, err)
+	}
+	m.log.Info("purged image", "tag", tag, "dst", dst)
+	m.metrics.purgedDigest(image)
+	return nil
+}
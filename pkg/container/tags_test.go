@@ -0,0 +1,144 @@
+package container
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	apiv1 "github.com/metal-stack/oci-mirror/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetTagsToCopy(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer srv.Close()
+	src := strings.TrimPrefix(srv.URL, "http://") + "/library/busybox"
+
+	img, err := random.Image(128, 1)
+	require.NoError(t, err)
+	for _, tag := range []string{"1.34.0", "1.35.0", "1.35.0-debug", "1.36.0", "1.36.0-rc1", "1.36.1", "1.37.0-rc1", "stable", "stable-debug"} {
+		ref, err := name.ParseReference(src + ":" + tag)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img))
+	}
+
+	tests := []struct {
+		name    string
+		match   apiv1.Match
+		rewrite *apiv1.TagRewrite
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "semver ignores pre-releases",
+			match: apiv1.Match{Semver: new(">= 1.36")},
+			want:  []string{"1.36.0", "1.36.1"},
+		},
+		{
+			name:  "semver includes pre-releases",
+			match: apiv1.Match{Semver: new(">= 1.36"), IncludePrereleases: true},
+			want:  []string{"1.36.0", "1.36.1", "1.37.0-rc1"},
+		},
+		{
+			name: "exclude tags, regex and semver",
+			match: apiv1.Match{
+				Semver:             new(">= 1.35"),
+				IncludePrereleases: true,
+				Exclude: &apiv1.Exclude{
+					Tags:   []string{"1.36.1"},
+					Regex:  new(`-rc[0-9]+$`),
+					Semver: new("< 1.36"),
+				},
+			},
+			want: []string{"1.36.0"},
+		},
+		{
+			name: "exclude glob from all tags",
+			match: apiv1.Match{
+				AllTags: true,
+				Exclude: &apiv1.Exclude{Glob: new("*-debug")},
+			},
+			want: []string{"1.34.0", "1.35.0", "1.36.0", "1.36.0-rc1", "1.36.1", "1.37.0-rc1", "stable"},
+		},
+		{
+			name: "exclude semver matches pre-releases",
+			match: apiv1.Match{
+				AllTags: true,
+				Exclude: &apiv1.Exclude{Semver: new(">= 1.36.0-0")},
+			},
+			want: []string{"1.34.0", "1.35.0", "1.35.0-debug", "stable", "stable-debug"},
+		},
+		{
+			name: "explicit tags are never excluded",
+			match: apiv1.Match{
+				Tags: []string{"stable-debug", "1.36.0-rc1"},
+				Glob: new("stable*"),
+				Exclude: &apiv1.Exclude{
+					Glob:  new("*-debug"),
+					Regex: new(`-rc[0-9]+$`),
+				},
+			},
+			want: []string{"1.36.0-rc1", "stable", "stable-debug"},
+		},
+		{
+			name: "exclude is applied before last",
+			match: apiv1.Match{
+				Last:    new(int64(2)),
+				Exclude: &apiv1.Exclude{Regex: new("-")},
+			},
+			want: []string{"1.36.0", "1.36.1"},
+		},
+		{
+			name:    "rewrite with prefix and suffix",
+			match:   apiv1.Match{Tags: []string{"1.36.0", "stable"}},
+			rewrite: &apiv1.TagRewrite{Prefix: "upstream-", Suffix: "-mirror"},
+			want:    []string{"upstream-1.36.0-mirror", "upstream-stable-mirror"},
+		},
+		{
+			name:    "rewrite with regex",
+			match:   apiv1.Match{Tags: []string{"1.35.0", "1.36.1", "stable"}},
+			rewrite: &apiv1.TagRewrite{Regex: new(`^(\d+)\.(\d+)\.\d+$`), Replacement: "$1.$2"},
+			want:    []string{"1.35", "1.36", "stable"},
+		},
+		{
+			name:    "rewrite to the same tag",
+			match:   apiv1.Match{Tags: []string{"stable", "stable-debug"}},
+			rewrite: &apiv1.TagRewrite{Regex: new("-debug$")},
+			wantErr: true,
+		},
+		{
+			name: "last with fewer tags than requested",
+			match: apiv1.Match{
+				Last:    new(int64(10)),
+				Exclude: &apiv1.Exclude{Semver: new("< 1.36"), Regex: new("-")},
+			},
+			want: []string{"1.36.0", "1.36.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(slog.New(slog.DiscardHandler), apiv1.Config{}, nil)
+			tags, err := m.listTags(src, nil)
+			require.NoError(t, err)
+			tagsToCopy, err := m.selectTags(apiv1.ImageMirror{Source: src, Destination: "dst/busybox", Match: tt.match, Rewrite: tt.rewrite}, tags)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var want []string
+			for _, tag := range tt.want {
+				want = append(want, "dst/busybox:"+tag)
+			}
+			require.ElementsMatch(t, want, tagsToCopy.destinationTags())
+		})
+	}
+}